@@ -9,8 +9,8 @@ import (
 	"time"
 )
 
-// Note: The current packet loss analyzer does not support udp over http.
-// This means we cannot get packet loss through a proxy.
+// Note: The packet loss analyzer can only relay udp packets through a socks5 proxy (UDP ASSOCIATE).
+// With an http proxy the packets are sent directly, see analyzer.ProxyBypassed().
 func main() {
 	// 0. Fetching servers
 	serverList, err := speedtest.FetchServers()
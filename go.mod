@@ -1,9 +1,10 @@
 module github.com/showwin/speedtest-go
 
-go 1.19
+go 1.24
 
 require (
 	github.com/chelnak/ysmrr v0.5.0
+	github.com/quic-go/quic-go v0.59.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 )
 
@@ -13,6 +14,10 @@ require (
 	github.com/fatih/color v1.18.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	golang.org/x/sys v0.28.0 // indirect
-	golang.org/x/term v0.27.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/term v0.34.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
 )
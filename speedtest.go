@@ -6,11 +6,15 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/showwin/speedtest-go/speedtest/transport"
@@ -21,7 +25,7 @@ import (
 
 var (
 	showList      = kingpin.Flag("list", "Show available speedtest.net servers.").Short('l').Bool()
-	serverIds     = kingpin.Flag("server", "Select server id to run speedtest.").Short('s').Ints()
+	serverIds     = kingpin.Flag("server", "Select server ids to run speedtest, repeatable or comma separated (e.g. 1,2,3).").Short('s').Strings()
 	customURL     = kingpin.Flag("custom-url", "Specify the url of the server instead of fetching from speedtest.net.").String()
 	savingMode    = kingpin.Flag("saving-mode", "Test with few resources, though low accuracy (especially > 30Mbps).").Bool()
 	jsonOutput    = kingpin.Flag("json", "Output results in json format.").Bool()
@@ -32,16 +36,45 @@ var (
 	showCityList  = kingpin.Flag("city-list", "List all predefined city labels.").Bool()
 	proxy         = kingpin.Flag("proxy", "Set a proxy(http[s] or socks) for the speedtest.").String()
 	source        = kingpin.Flag("source", "Bind a source interface for the speedtest.").String()
+	iface         = kingpin.Flag("interface", "Bind all sockets to a network interface by name (e.g. eth1).").String()
 	dnsBindSource = kingpin.Flag("dns-bind-source", "DNS request binding source (experimental).").Bool()
+	dnsServers    = kingpin.Flag("dns", "Use the given DNS server, repeatable (e.g. 1.1.1.1, tls://1.1.1.1, https://1.1.1.1/dns-query).").Strings()
+	caFile        = kingpin.Flag("ca-file", "Trust the CA certificates of a PEM file for https servers.").String()
+	clientCert    = kingpin.Flag("client-cert", "Present a client certificate (PEM) to https servers.").String()
+	clientKey     = kingpin.Flag("client-key", "Private key (PEM) of the client certificate.").String()
+	tlsMinVersion = kingpin.Flag("tls-min-version", "Set the minimum TLS version (1.0/1.1/1.2/1.3).").String()
+	insecure      = kingpin.Flag("insecure-skip-verify", "Do not verify the certificate of https servers (insecure).").Bool()
+	http3         = kingpin.Flag("http3", "Run download, upload and http ping over HTTP/3 (QUIC), http server urls are requested over https.").Bool()
 	multi         = kingpin.Flag("multi", "Enable multi-server mode.").Short('m').Bool()
+	parallel      = kingpin.Flag("parallel", "Test the selected servers at the same time and report their aggregate.").Bool()
 	thread        = kingpin.Flag("thread", "Set the number of concurrent connections.").Short('t').Int()
+	adaptive      = kingpin.Flag("adaptive", "Add connections while the throughput keeps increasing, --thread caps it.").Bool()
 	search        = kingpin.Flag("search", "Fuzzy search servers by a keyword.").String()
 	userAgent     = kingpin.Flag("ua", "Set the user-agent header for the speedtest.").String()
+	duration      = kingpin.Flag("duration", "Run each download/upload test for exactly this long (e.g. 30s).").Duration()
+	volume        = kingpin.Flag("bytes", "Stop each download/upload test after transferring a volume (e.g. 1GB, 500MiB), 10 minutes at most without --duration.").String()
+	auto          = kingpin.Flag("auto", "Stop each test once the rate is stable (default), --duration caps it.").Bool()
+	warmUp        = kingpin.Flag("warm-up", "Exclude the TCP slow start from the rates: a duration (e.g. 2s) or auto.").String()
+	maxData       = kingpin.Flag("max-data", "Limit the bytes of the whole run for metered links, the sockets never move more (e.g. 200MB).").String()
 	noDownload    = kingpin.Flag("no-download", "Disable download test.").Bool()
 	noUpload      = kingpin.Flag("no-upload", "Disable upload test.").Bool()
+	downloadSize  = kingpin.Flag("download-size", "Set the size of a download request, the image edge of the Ookla servers (350-4000).").Int()
+	uploadSize    = kingpin.Flag("upload-size", "Set the body size of an upload request (e.g. 1MB, 256KiB).").String()
+	downloadURL   = kingpin.Flag("download-url", "Set the download url template, relative to the server url, {size} is replaced by --download-size.").String()
+	uploadURL     = kingpin.Flag("upload-url", "Set the upload url template, relative to the server url.").String()
+	latencyURL    = kingpin.Flag("latency-url", "Set the http ping url template, relative to the server url.").String()
+	payload       = kingpin.Flag("payload", "Select the bytes of the upload bodies: random (incompressible) or pattern.").Default("random").String()
+	count         = kingpin.Flag("count", "Repeat the whole test sequence N times and report the aggregate statistics.").Default("1").Int()
+	interval      = kingpin.Flag("interval", "Wait between the repeated runs of --count (e.g. 1m).").Duration()
+	minDownload   = kingpin.Flag("min-download", "Exit with code 5 if the download rate of a server is below this many Mbps.").Float64()
+	minUpload     = kingpin.Flag("min-upload", "Exit with code 5 if the upload rate of a server is below this many Mbps.").Float64()
+	maxLatency    = kingpin.Flag("max-latency", "Exit with code 5 if the latency of a server is above this duration (e.g. 50ms).").Duration()
+	bidirectional = kingpin.Flag("bidirectional", "Also run download and upload at the same time, with the loaded latency.").Bool()
 	pingMode      = kingpin.Flag("ping-mode", "Select a method for Ping (support icmp/tcp/http).").Default("http").String()
 	unit          = kingpin.Flag("unit", "Set human-readable and auto-scaled rate units for output (options: decimal-bits/decimal-bytes/binary-bits/binary-bytes).").Short('u').String()
 	debug         = kingpin.Flag("debug", "Enable debug mode.").Short('d').Bool()
+	logFormat     = kingpin.Flag("log-format", "Set the format of the log records (options: text/json).").Default("text").Enum("text", "json")
+	logFile       = kingpin.Flag("log-file", "Write the log records to a file instead of stderr.").String()
 )
 
 var (
@@ -54,41 +87,96 @@ func main() {
 	kingpin.Parse()
 	AppInfo()
 
-	speedtest.SetUnit(parseUnit(*unit))
-
 	// discard standard log.
 	log.SetOutput(io.Discard)
 
+	if *count < 1 {
+		kingpin.Fatalf("--count must be at least 1")
+	}
+	if *count > 1 && len(*maxData) > 0 {
+		kingpin.Fatalf("--count can not be combined with --max-data, the budget covers a single run")
+	}
+	if *parallel && (*multi || *bidirectional || *count > 1) {
+		kingpin.Fatalf("--parallel can not be combined with --multi, --bidirectional or --count")
+	}
+	ids := parseServerIDs(*serverIds)
+
 	// start unix output for saving mode by default.
 	if *savingMode && !*jsonOutput && !*jsonlOutput && !*unixOutput {
 		*unixOutput = true
 	}
 
 	// 0. speed test setting
-	var speedtestClient = speedtest.New(speedtest.WithUserConfig(
+	logger := newLogger(*logFormat, *logFile, *debug)
+	var speedtestClient = speedtest.New(speedtest.WithLogger(logger))
+	if err := speedtestClient.NewUserConfig(
 		&speedtest.UserConfig{
-			UserAgent:      *userAgent,
-			Proxy:          *proxy,
-			Source:         *source,
-			DnsBindSource:  *dnsBindSource,
-			Debug:          *debug,
-			PingMode:       parseProto(*pingMode), // TCP as default
-			SavingMode:     *savingMode,
-			MaxConnections: *thread,
-			CityFlag:       *city,
-			LocationFlag:   *location,
-			Keyword:        *search,
-		}))
+			UserAgent:          *userAgent,
+			Proxy:              *proxy,
+			Source:             *source,
+			Interface:          *iface,
+			DnsBindSource:      *dnsBindSource,
+			DNS:                parseDNS(*dnsServers),
+			HTTP3:              *http3,
+			CAFile:             *caFile,
+			ClientCertFile:     *clientCert,
+			ClientKeyFile:      *clientKey,
+			TLSMinVersion:      *tlsMinVersion,
+			InsecureSkipVerify: *insecure,
+			MaxData:            parseSize(*maxData, "--max-data"),
+			DownloadSize:       *downloadSize,
+			UploadSize:         parseSize(*uploadSize, "--upload-size"),
+			DownloadURL:        *downloadURL,
+			UploadURL:          *uploadURL,
+			LatencyURL:         *latencyURL,
+			Debug:              *debug,
+			PingMode:           parseProto(*pingMode), // TCP as default
+			SavingMode:         *savingMode,
+			MaxConnections:     *thread,
+			CityFlag:           *city,
+			LocationFlag:       *location,
+			Keyword:            *search,
+		}); err != nil {
+		kingpin.Fatalf("%s", err)
+	}
+
+	speedtestClient.SetUnit(parseUnit(*unit))
+	policy := parseStopPolicy(*duration, *volume, *auto)
+	speedtestClient.SetDownloadStopPolicy(policy)
+	speedtestClient.SetUploadStopPolicy(policy)
+	speedtestClient.SetWarmUp(parseWarmUp(*warmUp))
+	speedtestClient.SetUploadPayload(parsePayload(*payload))
+	budget := speedtestClient.GetDataBudget()
+	if budget != nil {
+		phases := []speedtest.Phase{speedtest.PhasePing, speedtest.PhasePacketLoss}
+		if !*noDownload || *bidirectional {
+			phases = append(phases, speedtest.PhaseDownload)
+		}
+		if !*noUpload || *bidirectional {
+			phases = append(phases, speedtest.PhaseUpload)
+		}
+		budget.Plan(phases...)
+	}
+	if *adaptive && !*savingMode {
+		speedtestClient.SetAdaptiveThreads(&speedtest.AdaptiveThreads{Max: *thread})
+	}
 
 	if *showCityList {
-		speedtest.PrintCityList()
+		speedtestClient.PrintCityList()
 		return
 	}
 
+	// ctrl-c and SIGTERM cancel the tests, the completed results are still printed.
+	// A second signal kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
 	// 1. retrieving user information
 	taskManager := InitTaskManager(*jsonOutput || *jsonlOutput, *unixOutput)
+	failed := false // a download or upload test has no rate, or the packet loss analyzer failed
 	taskManager.AsyncRun("Retrieving User Information", func(task *Task) {
-		u, err := speedtestClient.FetchUserInfo()
+		u, err := speedtestClient.FetchUserInfoContext(ctx)
 		task.CheckError(err)
 		task.Printf("ISP: %s", u.String())
 		task.Complete()
@@ -105,19 +193,23 @@ func main() {
 			task.CheckError(err)
 			targets = []*speedtest.Server{target}
 			task.Println("Skip: Using Custom Server")
-		} else if len(*serverIds) > 0 {
+		} else if len(ids) > 0 {
 			// TODO: need async fetch to speedup
-			for _, id := range *serverIds {
-				serverPtr, errFetch := speedtestClient.FetchServerByID(strconv.Itoa(id))
+			for _, id := range ids {
+				serverPtr, errFetch := speedtestClient.FetchServerByIDContext(ctx, strconv.Itoa(id))
 				if errFetch != nil {
+					err = errFetch
 					continue // Silently Skip all ids that actually don't exist.
 				}
 				targets = append(targets, serverPtr)
 			}
+			if len(targets) > 0 {
+				err = nil
+			}
 			task.CheckError(err)
 			task.Printf("Found %d Specified Public Server(s)", len(targets))
 		} else {
-			servers, err = speedtestClient.FetchServers()
+			servers, err = speedtestClient.FetchServerListContext(ctx)
 			task.CheckError(err)
 			task.Printf("Found %d Public Servers", len(servers))
 			if *showList {
@@ -126,108 +218,204 @@ func main() {
 				showServerList(servers)
 				os.Exit(0)
 			}
-			targets, err = servers.FindServer(*serverIds)
+			if servers.Available().Len() == 0 {
+				task.CheckError(&speedtest.Error{Phase: speedtest.PhaseDiscovery, Err: speedtest.ErrNoAvailableServers})
+			}
+			targets, err = servers.FindServer(ids)
 			task.CheckError(err)
 		}
 		task.Complete()
 	})
 	taskManager.Reset()
 
-	// 3. test each selected server with ping, download and upload.
-	for _, server := range targets {
-		if !*jsonOutput && !*jsonlOutput {
-			fmt.Println()
-		}
-		taskManager.Println("Test Server: " + server.String())
-		taskManager.Run("Latency: --", func(task *Task) {
-			task.CheckError(server.PingTest(func(latency time.Duration) {
-				task.Updatef("Latency: %v", latency)
-			}))
-			task.Printf("Latency: %v Jitter: %v Min: %v Max: %v", server.Latency, server.Jitter, server.MinLatency, server.MaxLatency)
-			task.Complete()
-		})
-
-		// 3.0 create a packet loss analyzer, use default options
-		analyzer := speedtest.NewPacketLossAnalyzer(&speedtest.PacketLossAnalyzerOptions{
-			SourceInterface: *source,
-		})
-
-		blocker := sync.WaitGroup{}
-		packetLossAnalyzerCtx, packetLossAnalyzerCancel := context.WithTimeout(context.Background(), time.Second*40)
-		taskManager.Run("Packet Loss Analyzer", func(task *Task) {
-			blocker.Add(1)
-			go func() {
-				defer blocker.Done()
-				err = analyzer.RunWithContext(packetLossAnalyzerCtx, server.Host, func(packetLoss *transport.PLoss) {
-					server.PacketLoss = *packetLoss
+	// 3. test each selected server with ping, download and upload,
+	// or all of them at the same time with --parallel.
+	tested := 0 // targets with results, the others are left out once interrupted
+	sequential := targets
+	var aggregate *speedtest.Aggregate
+	if *parallel && len(targets) > 1 {
+		var pr *speedtest.ParallelResult
+		pr, failed = testParallel(ctx, speedtestClient, taskManager, targets)
+		aggregate = &pr.Aggregate
+		tested = len(targets)
+		sequential = nil
+	}
+	for _, server := range sequential {
+		tested++
+		for run := 1; run <= *count; run++ {
+			server.ResetRun()
+			if !*jsonOutput && !*jsonlOutput {
+				fmt.Println()
+			}
+			taskManager.Println("Test Server: " + server.String())
+			if *count > 1 {
+				taskManager.Println(fmt.Sprintf("Run: %d/%d", run, *count))
+			}
+			taskManager.Run("Latency: --", func(task *Task) {
+				checkError(ctx, task, server.PingTestContext(ctx, func(latency time.Duration) {
+					task.Updatef("Latency: %v", latency)
+				}))
+				task.Printf("Latency: %v Jitter: %v Min: %v Max: %v", server.Latency, server.Jitter, server.MinLatency, server.MaxLatency)
+				task.Complete()
+			})
+
+			// 3.0 create a packet loss analyzer, use the options of the client
+			analyzer := speedtestClient.NewPacketLossAnalyzer()
+			if analyzer.ProxyBypassed() {
+				server.MarkProxyBypass(speedtest.BypassPacketLoss)
+			}
+
+			blocker := sync.WaitGroup{}
+			packetLossAnalyzerCtx, packetLossAnalyzerCancel := context.WithTimeout(ctx, time.Second*40)
+			var lossErr error // read once the blocker is done
+			taskManager.Run("Packet Loss Analyzer", func(task *Task) {
+				blocker.Add(1)
+				go func() {
+					defer blocker.Done()
+					lossErr = server.PacketLossTestContext(packetLossAnalyzerCtx, analyzer)
+					if errors.Is(lossErr, transport.ErrUnsupported) {
+						packetLossAnalyzerCancel() // cancel early
+					}
+				}()
+				task.Println("Packet Loss Analyzer: Running in background (<= 30 Secs)")
+				task.Complete()
+			})
+
+			// 3.1 create accompany Echo
+			accEcho := newAccompanyEcho(server, time.Millisecond*500)
+			taskManager.RunWithTrigger(!*noDownload && ctx.Err() == nil, "Download", func(task *Task) {
+				accEcho.Run()
+				speedtestClient.SetCallbackDownload(func(downRate speedtest.ByteRate) {
+					lc := accEcho.CurrentLatency()
+					if lc == 0 {
+						task.Updatef("Download: %s (Latency: --)", speedtestClient.FormatRate(downRate))
+					} else {
+						task.Updatef("Download: %s (Latency: %dms)", speedtestClient.FormatRate(downRate), lc/1000000)
+					}
 				})
-				if errors.Is(err, transport.ErrUnsupported) {
-					packetLossAnalyzerCancel() // cancel early
-				}
-			}()
-			task.Println("Packet Loss Analyzer: Running in background (<= 30 Secs)")
-			task.Complete()
-		})
-
-		// 3.1 create accompany Echo
-		accEcho := newAccompanyEcho(server, time.Millisecond*500)
-		taskManager.RunWithTrigger(!*noDownload, "Download", func(task *Task) {
-			accEcho.Run()
-			speedtestClient.SetCallbackDownload(func(downRate speedtest.ByteRate) {
-				lc := accEcho.CurrentLatency()
-				if lc == 0 {
-					task.Updatef("Download: %s (Latency: --)", downRate)
+				if *multi {
+					checkError(ctx, task, server.MultiDownloadTestContext(ctx, servers))
 				} else {
-					task.Updatef("Download: %s (Latency: %dms)", downRate, lc/1000000)
+					checkError(ctx, task, server.DownloadTestContext(ctx))
 				}
+				accEcho.Stop()
+				failed = failed || server.DLSpeed < 0
+				mean, _, std, minL, maxL := speedtest.StandardDeviation(accEcho.Latencies())
+				task.Printf("Download: %s (Used: %.2fMB) (Latency: %dms Jitter: %dms Min: %dms Max: %dms)%s", speedtestClient.FormatRate(server.DLSpeed), float64(server.Manager().GetTotalDownload())/1000/1000, mean/1000000, std/1000000, minL/1000000, maxL/1000000, statsNote(server.DLStats))
+				task.Complete()
 			})
-			if *multi {
-				task.CheckError(server.MultiDownloadTestContext(context.Background(), servers))
-			} else {
-				task.CheckError(server.DownloadTest())
-			}
-			accEcho.Stop()
-			mean, _, std, minL, maxL := speedtest.StandardDeviation(accEcho.Latencies())
-			task.Printf("Download: %s (Used: %.2fMB) (Latency: %dms Jitter: %dms Min: %dms Max: %dms)", server.DLSpeed, float64(server.Context.Manager.GetTotalDownload())/1000/1000, mean/1000000, std/1000000, minL/1000000, maxL/1000000)
-			task.Complete()
-		})
-
-		taskManager.RunWithTrigger(!*noUpload, "Upload", func(task *Task) {
-			accEcho.Run()
-			speedtestClient.SetCallbackUpload(func(upRate speedtest.ByteRate) {
-				lc := accEcho.CurrentLatency()
-				if lc == 0 {
-					task.Updatef("Upload: %s (Latency: --)", upRate)
+
+			taskManager.RunWithTrigger(!*noUpload && ctx.Err() == nil, "Upload", func(task *Task) {
+				accEcho.Run()
+				speedtestClient.SetCallbackUpload(func(upRate speedtest.ByteRate) {
+					lc := accEcho.CurrentLatency()
+					if lc == 0 {
+						task.Updatef("Upload: %s (Latency: --)", speedtestClient.FormatRate(upRate))
+					} else {
+						task.Updatef("Upload: %s (Latency: %dms)", speedtestClient.FormatRate(upRate), lc/1000000)
+					}
+				})
+				if *multi {
+					checkError(ctx, task, server.MultiUploadTestContext(ctx, servers))
 				} else {
-					task.Updatef("Upload: %s (Latency: %dms)", upRate, lc/1000000)
+					checkError(ctx, task, server.UploadTestContext(ctx))
+				}
+				accEcho.Stop()
+				failed = failed || server.ULSpeed < 0
+				mean, _, std, minL, maxL := speedtest.StandardDeviation(accEcho.Latencies())
+				task.Printf("Upload: %s (Used: %.2fMB) (Latency: %dms Jitter: %dms Min: %dms Max: %dms)%s", speedtestClient.FormatRate(server.ULSpeed), float64(server.Manager().GetTotalUpload())/1000/1000, mean/1000000, std/1000000, minL/1000000, maxL/1000000, statsNote(server.ULStats))
+				task.Complete()
+			})
+
+			taskManager.RunWithTrigger(*bidirectional && ctx.Err() == nil, "Bidirectional", func(task *Task) {
+				var downRate, upRate atomic.Value
+				downRate.Store(speedtest.ByteRate(0))
+				upRate.Store(speedtest.ByteRate(0))
+				update := func() {
+					task.Updatef("Bidirectional: Download %s Upload %s", speedtestClient.FormatRate(downRate.Load().(speedtest.ByteRate)), speedtestClient.FormatRate(upRate.Load().(speedtest.ByteRate)))
 				}
+				speedtestClient.SetCallbackDownload(func(rate speedtest.ByteRate) {
+					downRate.Store(rate)
+					update()
+				})
+				speedtestClient.SetCallbackUpload(func(rate speedtest.ByteRate) {
+					upRate.Store(rate)
+					update()
+				})
+				checkError(ctx, task, server.BidirectionalTestContext(ctx))
+				r := server.Bidirectional
+				task.Printf("Bidirectional: Download %s Upload %s (Loaded Latency: %v Jitter: %v Min: %v Max: %v)", speedtestClient.FormatRate(r.DLSpeed), speedtestClient.FormatRate(r.ULSpeed), r.Latency, r.Jitter, r.MinLatency, r.MaxLatency)
+				task.Complete()
 			})
-			if *multi {
-				task.CheckError(server.MultiUploadTestContext(context.Background(), servers))
-			} else {
-				task.CheckError(server.UploadTest())
+
+			if *noUpload && *noDownload && !*bidirectional {
+				sleepContext(ctx, time.Second*30)
 			}
-			accEcho.Stop()
-			mean, _, std, minL, maxL := speedtest.StandardDeviation(accEcho.Latencies())
-			task.Printf("Upload: %s (Used: %.2fMB) (Latency: %dms Jitter: %dms Min: %dms Max: %dms)", server.ULSpeed, float64(server.Context.Manager.GetTotalUpload())/1000/1000, mean/1000000, std/1000000, minL/1000000, maxL/1000000)
-			task.Complete()
-		})
-
-		if *noUpload && *noDownload {
-			time.Sleep(time.Second * 30)
+			packetLossAnalyzerCancel()
+			blocker.Wait()
+			// the packet loss is N/A on the servers without the analyzer
+			if lossErr != nil && ctx.Err() == nil && !errors.Is(lossErr, transport.ErrUnsupported) &&
+				!errors.Is(lossErr, context.Canceled) && !errors.Is(lossErr, context.DeadlineExceeded) {
+				logger.Error("packet loss analyzer failed", "server", server.ID, "err", lossErr)
+				failed = true
+			}
+			if !*jsonOutput && !*jsonlOutput {
+				taskManager.Println(server.PacketLoss.String())
+				if len(server.ProxyBypass) > 0 {
+					taskManager.Println("Bypassed Proxy: " + strings.Join(server.ProxyBypass, ", "))
+				}
+				if server.TLS != nil {
+					taskManager.Println("TLS: " + server.TLS.Version + " " + server.TLS.CipherSuite)
+				}
+			}
+			taskManager.Reset()
+			speedtestClient.Manager.Reset()
+			if ctx.Err() != nil {
+				server.Partial = true
+			}
+			// an interrupted run is printed as partial but left out of the summary
+			if *count > 1 && ctx.Err() == nil {
+				server.RecordRun()
+				if run < *count {
+					sleepContext(ctx, *interval)
+				}
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if *count > 1 && !*jsonOutput && !*jsonlOutput {
+			fmt.Println()
+			printSummary(taskManager, server.Summary, speedtestClient.Unit())
 		}
-		packetLossAnalyzerCancel()
-		blocker.Wait()
-		if !*jsonOutput && !*jsonlOutput {
-			taskManager.Println(server.PacketLoss.String())
+		if ctx.Err() != nil {
+			break
 		}
-		taskManager.Reset()
-		speedtestClient.Manager.Reset()
+	}
+	if budget != nil {
+		taskManager.Println(dataUsage(budget))
+	}
+	targets = targets[:tested]
+	if ctx.Err() != nil {
+		taskManager.Println("Interrupted: the results are partial")
+	}
+	var violations []string
+	for _, server := range targets {
+		violations = append(violations, checkThresholds(server)...)
+	}
+	for _, violation := range violations {
+		taskManager.Println("Threshold: " + violation)
 	}
 	taskManager.Stop()
 
 	if *jsonOutput {
-		json, errMarshal := speedtestClient.JSON(targets)
+		var json []byte
+		var errMarshal error
+		if aggregate != nil {
+			json, errMarshal = speedtestClient.ParallelJSON(targets, *aggregate)
+		} else {
+			json, errMarshal = speedtestClient.JSON(targets)
+		}
 		if errMarshal != nil {
 			panic(errMarshal)
 		}
@@ -240,14 +428,31 @@ func main() {
 			}
 			fmt.Println(string(json))
 		}
+		if aggregate != nil {
+			json, errMarshal := speedtestClient.JSONLAggregate(*aggregate)
+			if errMarshal != nil {
+				panic(errMarshal)
+			}
+			fmt.Println(string(json))
+		}
+	}
+
+	if ctx.Err() != nil {
+		os.Exit(exitInterrupted)
+	} else if failed {
+		os.Exit(exitTestFailure)
+	} else if len(violations) > 0 {
+		os.Exit(exitThreshold)
 	}
 }
 
 type AccompanyEcho struct {
 	stopEcho       chan bool
+	done           chan struct{} // closed once the echo goroutine returned
 	server         *speedtest.Server
 	currentLatency int64
 	interval       time.Duration
+	mu             sync.Mutex
 	latencies      []int64
 }
 
@@ -260,9 +465,13 @@ func newAccompanyEcho(server *speedtest.Server, interval time.Duration) *Accompa
 }
 
 func (ae *AccompanyEcho) Run() {
+	ae.mu.Lock()
 	ae.latencies = make([]int64, 0)
+	ae.mu.Unlock()
+	ae.done = make(chan struct{})
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
+		defer close(ae.done)
 		for {
 			select {
 			case <-ae.stopEcho:
@@ -272,23 +481,165 @@ func (ae *AccompanyEcho) Run() {
 				latency, _ := ae.server.HTTPPing(ctx, 1, ae.interval, nil)
 				if len(latency) > 0 {
 					atomic.StoreInt64(&ae.currentLatency, latency[0])
+					ae.mu.Lock()
 					ae.latencies = append(ae.latencies, latency[0])
+					ae.mu.Unlock()
 				}
 			}
 		}
 	}()
 }
 
+// Stop ends the echo started by Run and waits for it.
 func (ae *AccompanyEcho) Stop() {
 	ae.stopEcho <- false
+	<-ae.done
 }
 
 func (ae *AccompanyEcho) CurrentLatency() int64 {
 	return atomic.LoadInt64(&ae.currentLatency)
 }
 
+// Latencies returns a copy of the latencies measured since Run.
 func (ae *AccompanyEcho) Latencies() []int64 {
-	return ae.latencies
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	return slices.Clone(ae.latencies)
+}
+
+func printSummary(tm *TaskManager, summary *speedtest.RunSummary, unit speedtest.UnitType) {
+	tm.Println(fmt.Sprintf("Summary of %d runs:", summary.Runs))
+	tm.Println("Latency: " + summary.Latency.LatencyString())
+	tm.Println("Jitter: " + summary.Jitter.LatencyString())
+	tm.Println("Download: " + summary.Download.RateString(unit))
+	tm.Println("Upload: " + summary.Upload.RateString(unit))
+	tm.Println("Packet Loss: " + summary.PacketLoss.String())
+	tm.Reset()
+}
+
+// checkThresholds returns the violations of --min-download, --min-upload and --max-latency by the server.
+func checkThresholds(server *speedtest.Server) []string {
+	var violations []string
+	if *minDownload > 0 && server.DLSpeed > 0 && server.DLSpeed.Mbps() < *minDownload {
+		violations = append(violations, fmt.Sprintf("server %s download %.2f Mbps < %.2f Mbps", server.ID, server.DLSpeed.Mbps(), *minDownload))
+	}
+	if *minUpload > 0 && server.ULSpeed > 0 && server.ULSpeed.Mbps() < *minUpload {
+		violations = append(violations, fmt.Sprintf("server %s upload %.2f Mbps < %.2f Mbps", server.ID, server.ULSpeed.Mbps(), *minUpload))
+	}
+	if *maxLatency > 0 && server.Latency > *maxLatency {
+		violations = append(violations, fmt.Sprintf("server %s latency %v > %v", server.ID, server.Latency, *maxLatency))
+	}
+	return violations
+}
+
+// testParallel tests the targets at the same time, each one with its own
+// manager. It prints the result of each server and their aggregate, and
+// reports whether a test failed.
+func testParallel(ctx context.Context, client *speedtest.Speedtest, tm *TaskManager, targets speedtest.Servers) (*speedtest.ParallelResult, bool) {
+	// the packet loss is analyzed before the transfers, they would disturb it
+	phases := []speedtest.Phase{speedtest.PhasePing, speedtest.PhasePacketLoss}
+	if !*noDownload {
+		phases = append(phases, speedtest.PhaseDownload)
+	}
+	if !*noUpload {
+		phases = append(phases, speedtest.PhaseUpload)
+	}
+	var pr *speedtest.ParallelResult
+	failed := false
+	if !*jsonOutput && !*jsonlOutput {
+		fmt.Println()
+	}
+	tm.Run(fmt.Sprintf("Testing %d Servers in Parallel", len(targets)), func(task *Task) {
+		var mu sync.Mutex
+		down := make([]speedtest.ByteRate, len(targets))
+		up := make([]speedtest.ByteRate, len(targets))
+		update := func() {
+			var d, u speedtest.ByteRate
+			for i := range targets {
+				d += down[i]
+				u += up[i]
+			}
+			task.Updatef("Parallel: Download %s Upload %s", client.FormatRate(d), client.FormatRate(u))
+		}
+		for i, server := range targets {
+			server.SetManager(client.NewManager())
+			server.Manager().SetCallbackDownload(func(rate speedtest.ByteRate) {
+				mu.Lock()
+				defer mu.Unlock()
+				down[i] = rate
+				update()
+			})
+			server.Manager().SetCallbackUpload(func(rate speedtest.ByteRate) {
+				mu.Lock()
+				defer mu.Unlock()
+				up[i] = rate
+				update()
+			})
+		}
+		var err error
+		pr, err = targets.RunParallel(ctx, phases...)
+		failed = ctx.Err() == nil && parallelFailed(err)
+		task.Printf("Tested %d Servers in Parallel", len(targets))
+		task.Complete()
+	})
+	for i, r := range pr.Results {
+		line := fmt.Sprintf("%s: Latency: %v Jitter: %v Download: %s Upload: %s %s", targets[i].String(), r.Latency, r.Jitter, client.FormatRate(r.DLSpeed), client.FormatRate(r.ULSpeed), r.PacketLoss.String())
+		for _, phase := range phases {
+			if msg, ok := r.Errors[phase]; ok {
+				line += fmt.Sprintf(" (%s: %s)", phase, msg)
+			}
+		}
+		tm.Println(line)
+	}
+	a := pr.Aggregate
+	tm.Println(fmt.Sprintf("Aggregate: Download %s Upload %s (Latency: %v Jitter: %v) %s", client.FormatRate(a.DLSpeed), client.FormatRate(a.ULSpeed), a.Latency, a.Jitter, a.PacketLoss.String()))
+	tm.Reset()
+	return pr, failed
+}
+
+// parallelFailed reports whether the joined errors of the servers hold one
+// beyond an unsupported packet loss analyzer, the packet loss is N/A then.
+func parallelFailed(err error) bool {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			if parallelFailed(e) {
+				return true
+			}
+		}
+		return false
+	}
+	return err != nil && !errors.Is(err, transport.ErrUnsupported)
+}
+
+// parseServerIDs parses the repeated and comma separated server ids.
+func parseServerIDs(values []string) []int {
+	var ids []int
+	for _, value := range values {
+		for _, str := range strings.Split(value, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(str))
+			if err != nil {
+				kingpin.Fatalf("--server: invalid server id %q", str)
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// checkError ends the command on the error of a test, unless the test was
+// interrupted or its transfer failed: the rate is reported as N/A instead.
+func checkError(ctx context.Context, task *Task, err error) {
+	if ctx.Err() == nil && !errors.Is(err, speedtest.ErrTransferFailed) {
+		task.CheckError(err)
+	}
+}
+
+// sleepContext sleeps for the duration or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
 }
 
 func showServerList(servers speedtest.Servers) {
@@ -319,6 +670,97 @@ func parseUnit(str string) speedtest.UnitType {
 	}
 }
 
+func parseStopPolicy(duration time.Duration, volume string, auto bool) speedtest.StopPolicy {
+	if len(volume) > 0 {
+		if auto {
+			kingpin.Fatalf("--bytes and --auto are exclusive")
+		}
+		bytes, err := speedtest.ParseByteSize(volume)
+		kingpin.FatalIfError(err, "--bytes")
+		return speedtest.StopPolicy{Mode: speedtest.StopVolume, Bytes: bytes, Duration: duration}
+	}
+	if duration > 0 && !auto {
+		return speedtest.StopPolicy{Mode: speedtest.StopDuration, Duration: duration}
+	}
+	return speedtest.StopPolicy{Mode: speedtest.StopAuto, Duration: duration}
+}
+
+func parseSize(str string, flag string) int64 {
+	if len(str) == 0 {
+		return 0
+	}
+	size, err := speedtest.ParseByteSize(str)
+	kingpin.FatalIfError(err, "%s", flag)
+	return size
+}
+
+func dataUsage(budget *speedtest.DataBudget) string {
+	usage := budget.Usage()
+	var phases []string
+	for _, phase := range []speedtest.Phase{speedtest.PhasePing, speedtest.PhaseDownload, speedtest.PhaseUpload, speedtest.PhasePacketLoss} {
+		phases = append(phases, fmt.Sprintf("%s %.2fMB", phase, float64(usage[phase])/1000/1000))
+	}
+	return fmt.Sprintf("Data Used: %.2fMB of %.2fMB (%s)", float64(budget.Total())/1000/1000, float64(budget.Limit())/1000/1000, strings.Join(phases, ", "))
+}
+
+func parsePayload(str string) speedtest.Payload {
+	payload, err := speedtest.ParsePayload(str)
+	kingpin.FatalIfError(err, "--payload")
+	return payload
+}
+
+func parseWarmUp(str string) time.Duration {
+	if len(str) == 0 {
+		return 0
+	}
+	if strings.ToLower(str) == "auto" {
+		return speedtest.WarmUpAuto
+	}
+	d, err := time.ParseDuration(str)
+	kingpin.FatalIfError(err, "--warm-up")
+	return d
+}
+
+func statsNote(stats speedtest.TransferStats) string {
+	var note string
+	if stats.WarmUp != 0 {
+		note += fmt.Sprintf(" (Warm-up: %v)", stats.WarmUp.Round(time.Millisecond))
+	}
+	if len(stats.ConnectionCurve) > 0 {
+		note += fmt.Sprintf(" (Connections: %d)", stats.Connections)
+	}
+	if len(stats.Quality.StopReason) > 0 {
+		note += " (" + stats.Quality.String() + ")"
+	}
+	return note
+}
+
+// newLogger logs to stderr or to the file, at debug level if debug is set
+// and only the warnings and errors without it.
+func newLogger(format string, file string, debug bool) *slog.Logger {
+	var w io.Writer = os.Stderr
+	if len(file) > 0 {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		kingpin.FatalIfError(err, "--log-file")
+		w = f
+	}
+	opts := &slog.HandlerOptions{Level: slog.LevelWarn}
+	if debug {
+		opts.Level = slog.LevelDebug
+	}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+func parseDNS(servers []string) *speedtest.DNSConfig {
+	if len(servers) == 0 {
+		return nil
+	}
+	return &speedtest.DNSConfig{Servers: servers}
+}
+
 func parseProto(str string) speedtest.Proto {
 	str = strings.ToLower(str)
 	if str == "icmp" {
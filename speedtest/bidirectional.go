@@ -0,0 +1,105 @@
+package speedtest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BidirectionalResult is the outcome of the download and upload tests run at the same time.
+type BidirectionalResult struct {
+	DLSpeed  ByteRate      `json:"dl_speed"`
+	ULSpeed  ByteRate      `json:"ul_speed"`
+	DLStats  TransferStats `json:"dl_stats"`
+	ULStats  TransferStats `json:"ul_stats"`
+	Duration time.Duration `json:"duration"`
+
+	// http latency under the combined load
+	Latency    time.Duration `json:"latency"`
+	Jitter     time.Duration `json:"jitter"`
+	MinLatency time.Duration `json:"min_latency"`
+	MaxLatency time.Duration `json:"max_latency"`
+}
+
+// BidirectionalTest runs the download and upload tests at the same time
+// against the server, and measures the latency under the combined load.
+func (s *Server) BidirectionalTest() error {
+	return s.bidirectionalTestContext(context.Background(), downloadRequest, uploadRequest)
+}
+
+// BidirectionalTestContext runs the download and upload tests at the same time, observing the given context.
+func (s *Server) BidirectionalTestContext(ctx context.Context) error {
+	return s.bidirectionalTestContext(ctx, downloadRequest, uploadRequest)
+}
+
+func (s *Server) bidirectionalTestContext(ctx context.Context, downloadRequest downloadFunc, uploadRequest uploadFunc) error {
+	// the sockets carry both directions, their usage is shared by the payload volumes
+	counter := s.usageCounter()
+	start := atomic.LoadInt64(counter)
+	dlStart, ulStart := s.Manager().GetTotalDownload(), s.Manager().GetTotalUpload()
+	dlShare := func(used int64) int64 {
+		dl, ul := s.Manager().GetTotalDownload()-dlStart, s.Manager().GetTotalUpload()-ulStart
+		if dl+ul <= 0 {
+			return used / 2
+		}
+		return int64(float64(used) * float64(dl) / float64(dl+ul))
+	}
+	recordDL := s.meterUsage(PhaseDownload, func() int64 { return dlShare(atomic.LoadInt64(counter) - start) })
+	recordUL := s.meterUsage(PhaseUpload, func() int64 {
+		used := atomic.LoadInt64(counter) - start
+		return used - dlShare(used)
+	})
+	pingCtx, stopPing := context.WithCancel(ctx)
+	defer stopPing()
+	var latencies []int64
+	pingDone := make(chan struct{})
+	go func() {
+		defer close(pingDone)
+		// pings until the load ends, the first one warms up the connection
+		latencies, _ = s.HTTPPing(pingCtx, maxLoadedPings, loadedPingInterval, nil)
+	}()
+
+	var dl, ul transferResult
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		dl = s.runTransfer(ctx, PhaseDownload, s.Manager().RegisterDownloadHandler, downloadRequest, 3)
+	}()
+	go func() {
+		defer wg.Done()
+		ul = s.runTransfer(ctx, PhaseUpload, s.Manager().RegisterUploadHandler, uploadRequest, 4)
+	}()
+	wg.Wait()
+	stopPing()
+	<-pingDone
+
+	result := &BidirectionalResult{
+		DLSpeed:  dl.rate,
+		ULSpeed:  ul.rate,
+		DLStats:  dl.stats,
+		ULStats:  ul.stats,
+		Duration: max(dl.duration, ul.duration),
+	}
+	if len(latencies) > 0 {
+		mean, _, std, minLatency, maxLatency := StandardDeviation(latencies)
+		result.Latency = time.Duration(mean)
+		result.Jitter = time.Duration(std)
+		result.MinLatency = time.Duration(minLatency)
+		result.MaxLatency = time.Duration(maxLatency)
+	}
+	s.Bidirectional = result
+
+	used := atomic.LoadInt64(counter) - start
+	dlUsed := dlShare(used)
+	recordDL(dlUsed)
+	recordUL(used - dlUsed)
+	s.observeTLS(dl.tracer)
+	return nil
+}
+
+const (
+	maxLoadedPings     = 1 << 20
+	loadedPingInterval = 200 * time.Millisecond
+)
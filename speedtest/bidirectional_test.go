@@ -0,0 +1,53 @@
+package speedtest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBidirectional(t *testing.T) {
+	ts := newSpeedtestStandIn(256 * 1024)
+	defer ts.Close()
+
+	c := New()
+	c.SetNThread(2)
+	policy := StopPolicy{Mode: StopDuration, Duration: time.Second}
+	c.SetDownloadStopPolicy(policy)
+	c.SetUploadStopPolicy(policy)
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.BidirectionalTest(); err != nil {
+		t.Fatal(err)
+	}
+	r := server.Bidirectional
+	if r == nil {
+		t.Fatal("the bidirectional result is not set")
+	}
+	if r.DLSpeed <= 0 || r.ULSpeed <= 0 {
+		t.Errorf("got unexpected speed, download: %v, upload: %v", r.DLSpeed, r.ULSpeed)
+	}
+	// both directions run at the same time
+	if r.Duration < time.Second || r.Duration > 1900*time.Millisecond {
+		t.Errorf("got unexpected duration %v", r.Duration)
+	}
+	if r.Latency <= 0 || r.MinLatency > r.MaxLatency {
+		t.Errorf("got unexpected loaded latency %+v", r)
+	}
+	if server.DataUsage[PhaseDownload] <= 0 || server.DataUsage[PhaseUpload] <= 0 {
+		t.Errorf("got unexpected usage %v", server.DataUsage)
+	}
+	// the sequential results are left untouched
+	if server.DLSpeed != 0 || server.ULSpeed != 0 {
+		t.Errorf("got unexpected sequential speed, download: %v, upload: %v", server.DLSpeed, server.ULSpeed)
+	}
+
+	// a sequential test still runs after the combined one
+	if err = server.DownloadTest(); err != nil {
+		t.Fatal(err)
+	}
+	if server.DLSpeed <= 0 {
+		t.Errorf("got unexpected download speed %v", server.DLSpeed)
+	}
+}
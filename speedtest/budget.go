@@ -0,0 +1,383 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/showwin/speedtest-go/speedtest/transport"
+)
+
+// Phase is a stage of a speedtest run.
+type Phase string
+
+const (
+	PhasePing       Phase = "ping"
+	PhaseDownload   Phase = "download"
+	PhaseUpload     Phase = "upload"
+	PhasePacketLoss Phase = "packet_loss"
+)
+
+// ErrDataBudgetSpent is returned by the reads and writes of the sockets that
+// would move more bytes than the limit of the data budget.
+var ErrDataBudgetSpent = errors.New("data budget spent")
+
+const (
+	pingReserve       = 64 * 1024  // 11 http pings and the handshakes
+	packetLossReserve = 256 * 1024 // 30s of packets and remote sampling
+	budgetOverhead    = 0.05       // share of the transfer allotments kept for the bytes buffered on the connections
+)
+
+// DataBudget caps the data volume of a run. The limit is planned up front
+// into an allotment per phase: ping and packet loss get a small reserve, the
+// rest is split evenly between download and upload. The usage counts the bytes
+// read and written on the sockets. An allotment is a pool shared by all the
+// tests of its phase, the servers tested at the same time included: the tests
+// see the bytes of each other while they run.
+//
+// The limit is a hard guarantee: the bytes counted on the sockets of the
+// client, the discovery included, never exceed it. A read is cut to the bytes
+// left and a write that does not fit fails with ErrDataBudgetSpent. The tests
+// stop before that: a transfer once the bytes of its phase on the wire plus
+// its next reservation would exceed the allotment less a margin for the bytes
+// buffered on the connections, the pings and packets once their allotment is
+// spent.
+type DataBudget struct {
+	mu      sync.Mutex
+	limit   int64
+	moved   int64 // counted on the sockets, never above the limit
+	plan    map[Phase]int64
+	used    map[Phase]int64
+	pending map[Phase]int64           // reserved by the transfers, not moved yet
+	meters  map[*budgetMeter]struct{} // of the running tests
+}
+
+// budgetMeter shows the bytes moved by a running test of the phase, until
+// the test books them.
+type budgetMeter struct {
+	phase Phase
+	bytes func() int64
+}
+
+// NewDataBudget returns a budget of limit bytes planned over all phases.
+func NewDataBudget(limit int64) *DataBudget {
+	b := &DataBudget{
+		limit:   limit,
+		used:    map[Phase]int64{},
+		pending: map[Phase]int64{},
+		meters:  map[*budgetMeter]struct{}{},
+	}
+	b.Plan(PhasePing, PhaseDownload, PhaseUpload, PhasePacketLoss)
+	return b
+}
+
+// Plan distributes the limit over the given phases only, the others get nothing.
+func (b *DataBudget) Plan(phases ...Phase) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.plan = map[Phase]int64{}
+	left := b.limit
+	var transfers []Phase
+	for _, phase := range phases {
+		switch phase {
+		case PhasePing:
+			b.plan[phase] = min(pingReserve, b.limit/20)
+		case PhasePacketLoss:
+			b.plan[phase] = min(packetLossReserve, b.limit/20)
+		default:
+			transfers = append(transfers, phase)
+			continue
+		}
+		left -= b.plan[phase]
+	}
+	for _, phase := range transfers {
+		b.plan[phase] = left / int64(len(transfers))
+	}
+}
+
+// Limit returns the total bytes allowed.
+func (b *DataBudget) Limit() int64 {
+	return b.limit
+}
+
+// Allotment returns the bytes planned for the phase.
+func (b *DataBudget) Allotment(phase Phase) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.plan[phase]
+}
+
+// Remaining returns the bytes of the phase allotment left, 0 once it is
+// spent. The bytes of the running tests count as spent.
+func (b *DataBudget) Remaining(phase Phase) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return max(b.plan[phase]-b.inUse(phase), 0)
+}
+
+// Used returns the bytes used by the phase.
+func (b *DataBudget) Used(phase Phase) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used[phase]
+}
+
+// Usage returns the bytes used by each phase.
+func (b *DataBudget) Usage() map[Phase]int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	usage := make(map[Phase]int64, len(b.used))
+	for phase, n := range b.used {
+		usage[phase] = n
+	}
+	return usage
+}
+
+// Total returns the bytes used by all phases.
+func (b *DataBudget) Total() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var total int64
+	for _, n := range b.used {
+		total += n
+	}
+	return total
+}
+
+func (b *DataBudget) add(phase Phase, n int64) {
+	b.mu.Lock()
+	b.used[phase] += n
+	b.mu.Unlock()
+}
+
+// inUse returns the bytes of the phase used, moved by the running tests and
+// reserved, the caller holds b.mu.
+func (b *DataBudget) inUse(phase Phase) int64 {
+	n := b.used[phase] + b.pending[phase]
+	for m := range b.meters {
+		if m.phase == phase {
+			n += m.bytes()
+		}
+	}
+	return n
+}
+
+// meter registers the bytes moved by a running test of the phase, see book.
+func (b *DataBudget) meter(phase Phase, bytes func() int64) *budgetMeter {
+	m := &budgetMeter{phase: phase, bytes: bytes}
+	b.mu.Lock()
+	b.meters[m] = struct{}{}
+	b.mu.Unlock()
+	return m
+}
+
+// book ends the meter and adds the usage of its test at once, so the bytes
+// never leave the pool of the phase in between.
+func (b *DataBudget) book(m *budgetMeter, n int64) {
+	b.mu.Lock()
+	delete(b.meters, m)
+	b.used[m.phase] += n
+	b.mu.Unlock()
+}
+
+// reserve takes up to n bytes of the phase allotment less the margin of the
+// transfers, it returns 0 once the allotment is spent. The reservation holds
+// until the bytes are moved and release gives it back.
+func (b *DataBudget) reserve(phase Phase, n int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	left := int64(float64(b.plan[phase])*(1-budgetOverhead)) - b.inUse(phase)
+	k := max(min(n, left), 0)
+	b.pending[phase] += k
+	return k
+}
+
+// release gives back a reservation, once its bytes are counted by a meter or
+// not moved at all.
+func (b *DataBudget) release(phase Phase, n int64) {
+	b.mu.Lock()
+	b.pending[phase] -= n
+	b.mu.Unlock()
+}
+
+// limitRead cuts a read buffer to the bytes left under the limit and counts
+// them as moved, see settle. A read takes half of the bytes left at most: the
+// reads waiting on idle connections never starve the writes. A nil budget has
+// no limit.
+func (b *DataBudget) limitRead(p []byte) ([]byte, error) {
+	if b == nil || len(p) == 0 {
+		return p, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	left := b.limit - b.moved
+	if left <= 0 {
+		return nil, ErrDataBudgetSpent
+	}
+	k := min(int64(len(p)), max(left/2, 1))
+	b.moved += k
+	return p[:k], nil
+}
+
+// limitWrite counts the n bytes of a write as moved if they all fit under the
+// limit, see settle. A nil budget has no limit.
+func (b *DataBudget) limitWrite(n int) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.moved+int64(n) > b.limit {
+		return ErrDataBudgetSpent
+	}
+	b.moved += int64(n)
+	return nil
+}
+
+// settle gives back the bytes of limitRead or limitWrite that were not moved.
+func (b *DataBudget) settle(granted, n int) {
+	if b == nil || granted == n {
+		return
+	}
+	b.mu.Lock()
+	b.moved -= int64(granted - max(n, 0))
+	b.mu.Unlock()
+}
+
+// countingConn counts the bytes read and written on a connection, within the
+// limit of the budget if any.
+type countingConn struct {
+	net.Conn
+	add    func(n int64)
+	budget *DataBudget
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	b, err := c.budget.limitRead(b)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	c.budget.settle(len(b), n)
+	c.add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	if err := c.budget.limitWrite(len(b)); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(b)
+	c.budget.settle(len(b), n)
+	c.add(int64(n))
+	return n, err
+}
+
+// countingPacketConn counts the bytes of the datagrams read and written on a
+// packet connection, within the limit of the budget if any.
+type countingPacketConn struct {
+	net.PacketConn
+	add    func(n int64)
+	budget *DataBudget
+}
+
+func (c *countingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	b, err := c.budget.limitRead(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	c.budget.settle(len(b), n)
+	c.add(int64(n))
+	return n, addr, err
+}
+
+func (c *countingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if err := c.budget.limitWrite(len(b)); err != nil {
+		return 0, err
+	}
+	n, err := c.PacketConn.WriteTo(b, addr)
+	c.budget.settle(len(b), n)
+	c.add(int64(n))
+	return n, err
+}
+
+// countingDialer counts the bytes of the dialed connections into a phase of the budget.
+type countingDialer struct {
+	transport.Dialer
+	budget *DataBudget
+	phase  Phase
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, add: func(n int64) { d.budget.add(d.phase, n) }, budget: d.budget}, nil
+}
+
+type wireBytesKey struct{}
+
+// countConn counts the bytes of the connection into the client usage, and
+// into the usage of the server dialing it with its own counter. The data
+// budget of the client at that point, if any, limits the connection.
+func (s *Speedtest) countConn(ctx context.Context, conn net.Conn) net.Conn {
+	server, _ := ctx.Value(wireBytesKey{}).(*int64)
+	return &countingConn{Conn: conn, add: func(n int64) {
+		atomic.AddInt64(&s.wireBytes, n)
+		if server != nil {
+			atomic.AddInt64(server, n)
+		}
+	}, budget: s.GetDataBudget()}
+}
+
+// usageCounter returns the counter of the bytes moved for the server, the
+// client counter unless the server has its own manager.
+func (s *Server) usageCounter() *int64 {
+	if s.wireBytes != nil {
+		return s.wireBytes
+	}
+	return &s.Context.wireBytes
+}
+
+// trackUsage records the bytes moved for the server until the returned
+// function is called as the usage of the phase, in the server result and
+// the data budget if any.
+func (s *Server) trackUsage(phase Phase) func() {
+	counter := s.usageCounter()
+	start := atomic.LoadInt64(counter)
+	record := s.meterUsage(phase, func() int64 { return atomic.LoadInt64(counter) - start })
+	return func() {
+		record(atomic.LoadInt64(counter) - start)
+	}
+}
+
+// meterUsage shows the bytes moved by a test of the phase to the data budget,
+// if any, while the test runs. The returned function records the usage of the
+// test in the server result and the budget.
+func (s *Server) meterUsage(phase Phase, bytes func() int64) func(n int64) {
+	budget := s.Manager().GetDataBudget()
+	var m *budgetMeter
+	if budget != nil {
+		m = budget.meter(phase, bytes)
+	}
+	return func(n int64) {
+		if s.DataUsage == nil {
+			s.DataUsage = map[Phase]int64{}
+		}
+		s.DataUsage[phase] += n
+		if m != nil {
+			budget.book(m, n)
+		}
+	}
+}
+
+// budgetSpent reports whether the allotment of the phase in the data budget,
+// if any, is spent.
+func (s *Server) budgetSpent(phase Phase) bool {
+	budget := s.Manager().GetDataBudget()
+	return budget != nil && budget.Remaining(phase) == 0
+}
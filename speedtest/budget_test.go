@@ -0,0 +1,137 @@
+package speedtest
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDataBudgetPlan(t *testing.T) {
+	b := NewDataBudget(100 * MB)
+	if b.Allotment(PhasePing) != pingReserve || b.Allotment(PhasePacketLoss) != packetLossReserve {
+		t.Errorf("got unexpected reserves %d, %d", b.Allotment(PhasePing), b.Allotment(PhasePacketLoss))
+	}
+	transfer := int64(100*MB-pingReserve-packetLossReserve) / 2
+	if b.Allotment(PhaseDownload) != transfer || b.Allotment(PhaseUpload) != transfer {
+		t.Errorf("got unexpected transfer allotments %d, %d", b.Allotment(PhaseDownload), b.Allotment(PhaseUpload))
+	}
+
+	b.Plan(PhasePing, PhaseDownload)
+	if b.Allotment(PhaseUpload) != 0 || b.Allotment(PhaseDownload) != 100*MB-pingReserve {
+		t.Errorf("got unexpected allotments without upload %d, %d", b.Allotment(PhaseDownload), b.Allotment(PhaseUpload))
+	}
+
+	// the reserves never exceed 5% of a tiny budget
+	if small := NewDataBudget(100 * KB); small.Allotment(PhasePing) != 5*KB {
+		t.Errorf("got unexpected ping reserve %d", small.Allotment(PhasePing))
+	}
+}
+
+func TestDataBudget(t *testing.T) {
+	ts := newSpeedtestStandIn(256 * 1024)
+	defer ts.Close()
+
+	const limit = 8 * MB
+	c := New(WithDoer(&http.Client{}), WithUserConfig(&UserConfig{MaxData: limit}))
+	c.SetCaptureTime(10 * time.Second)
+	budget := c.GetDataBudget()
+	if budget == nil {
+		t.Fatal("the data budget is not set")
+	}
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.PingTest(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.DownloadTest(); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.UploadTest(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, phase := range []Phase{PhaseDownload, PhaseUpload} {
+		used, allotment := budget.Used(phase), budget.Allotment(phase)
+		if used > allotment || used < allotment/2 {
+			t.Errorf("%s used %d bytes of its %d allotment", phase, used, allotment)
+		}
+		if server.DataUsage[phase] != used {
+			t.Errorf("got %s usage %d in the result, expected %d", phase, server.DataUsage[phase], used)
+		}
+	}
+	if server.DataUsage[PhasePing] <= 0 {
+		t.Error("the ping usage is not recorded")
+	}
+	if budget.Total() > limit {
+		t.Errorf("used %d bytes over the %d limit", budget.Total(), int64(limit))
+	}
+	if moved := atomic.LoadInt64(&c.wireBytes); moved > limit {
+		t.Errorf("moved %d bytes over the %d limit", moved, int64(limit))
+	}
+	if *server.TestDuration.Download >= 10*time.Second || *server.TestDuration.Upload >= 10*time.Second {
+		t.Error("the tests did not stop on the data budget")
+	}
+}
+
+func TestDataBudgetPing(t *testing.T) {
+	ts := newSpeedtestStandIn(256 * 1024)
+	defer ts.Close()
+
+	// a ping allotment of 200 bytes is spent by the warm up and the first echo
+	c := New(WithDoer(&http.Client{}), WithUserConfig(&UserConfig{MaxData: 4 * KB}))
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples int
+	if err = server.PingTest(func(time.Duration) { samples++ }); err != nil {
+		t.Fatal(err)
+	}
+	if samples != 1 || server.Latency <= 0 {
+		t.Errorf("got %d samples and a latency of %v, want the pings to stop after the first", samples, server.Latency)
+	}
+}
+
+func TestDataBudgetLimit(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	var counted int64
+	budget := NewDataBudget(100)
+	conn := &countingConn{Conn: local, add: func(n int64) { counted += n }, budget: budget}
+
+	// a write is moved whole or not at all
+	go func() { _, _ = remote.Read(make([]byte, 100)) }()
+	if n, err := conn.Write(make([]byte, 60)); n != 60 || err != nil {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if n, err := conn.Write(make([]byte, 60)); n != 0 || !errors.Is(err, ErrDataBudgetSpent) {
+		t.Errorf("the write over the limit got %d, %v", n, err)
+	}
+
+	// a read is cut to half of the bytes left, until none are
+	go func() { _, _ = remote.Write(make([]byte, 100)) }()
+	buf := make([]byte, 100)
+	var read int
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !errors.Is(err, ErrDataBudgetSpent) {
+				t.Fatal(err)
+			}
+			break
+		}
+		if left := 40 - read; n > max(left/2, 1) {
+			t.Errorf("read %d of the %d bytes left", n, left)
+		}
+		read += n
+	}
+	if counted != 100 {
+		t.Errorf("counted %d bytes, want the 100 of the limit", counted)
+	}
+}
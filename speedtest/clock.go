@@ -0,0 +1,69 @@
+package speedtest
+
+import "time"
+
+// Clock is the time source of the rate capture, the stop criteria and the
+// test durations, the wall clock by default. A simulated clock makes the
+// tests deterministic, see WithClock and DataManager.SetClock. The latency
+// samples are always measured on the wall clock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a timer of a Clock started by AfterFunc.
+type Timer interface {
+	Stop() bool
+}
+
+// Ticker is a ticker of a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// wallClock is the Clock of the time package.
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (wallClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (wallClock) NewTicker(d time.Duration) Ticker {
+	return wallTicker{time.NewTicker(d)}
+}
+
+type wallTicker struct {
+	*time.Ticker
+}
+
+func (t wallTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// WithClock replaces the wall clock of the client and of its manager, nil restores it.
+func WithClock(clock Clock) Option {
+	return func(s *Speedtest) {
+		s.setClock(clock)
+	}
+}
+
+func (s *Speedtest) setClock(clock Clock) {
+	if clock == nil {
+		clock = wallClock{}
+	}
+	s.clock = clock
+	if dm, ok := s.Manager.(*DataManager); ok {
+		dm.SetClock(clock)
+	}
+}
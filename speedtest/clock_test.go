@@ -0,0 +1,183 @@
+package speedtest
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock moved forward by Advance only. The functions of
+// AfterFunc run on the goroutine calling Advance, so a test stopped by a
+// timer has stopped once Advance returns. The tickers drop the ticks that
+// are not received in time, like the ones of the time package.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    int
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	seq    int           // orders the timers due at the same time
+	period time.Duration // of a ticker
+	f      func()        // of AfterFunc
+	c      chan time.Time
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) schedule(d, period time.Duration, f func()) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &fakeTimer{clock: c, when: c.now.Add(d), seq: c.seq, period: period, f: f}
+	if f == nil {
+		t.c = make(chan time.Time, 1)
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.schedule(d, 0, nil).c
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.schedule(d, 0, f)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.schedule(d, d, nil)}
+}
+
+// Advance moves the clock forward by d, firing the timers due on the way in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if t.when.After(end) {
+				continue
+			}
+			if next == nil || t.when.Before(next.when) || (t.when.Equal(next.when) && t.seq < next.seq) {
+				next = t
+			}
+		}
+		if next == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		c.now = next.when
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			c.remove(next)
+		}
+		now := c.now
+		c.mu.Unlock()
+		if next.f != nil {
+			next.f()
+			continue
+		}
+		select {
+		case next.c <- now:
+		default:
+		}
+	}
+}
+
+// remove drops the timer, the caller holds c.mu.
+func (c *fakeClock) remove(t *fakeTimer) bool {
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.remove(t)
+}
+
+func (t fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	ticker := clock.NewTicker(100 * time.Millisecond)
+	var fired []time.Duration
+	clock.AfterFunc(250*time.Millisecond, func() {
+		fired = append(fired, clock.Now().Sub(start))
+	})
+	after := clock.After(time.Second)
+
+	clock.Advance(300 * time.Millisecond)
+	if len(fired) != 1 || fired[0] != 250*time.Millisecond {
+		t.Errorf("got the timer fired at %v, want 250ms", fired)
+	}
+	// the ticks that are not received are dropped
+	if tick := <-ticker.C(); tick.Sub(start) != 100*time.Millisecond {
+		t.Errorf("got a tick at %v, want 100ms", tick.Sub(start))
+	}
+	select {
+	case <-ticker.C():
+		t.Error("got a dropped tick")
+	default:
+	}
+	ticker.Stop()
+	clock.Advance(time.Second)
+	select {
+	case <-ticker.C():
+		t.Error("got a tick of a stopped ticker")
+	case now := <-after:
+		if now.Sub(start) != time.Second {
+			t.Errorf("got After at %v, want 1s", now.Sub(start))
+		}
+	}
+	if clock.Now().Sub(start) != 1300*time.Millisecond {
+		t.Errorf("got the clock at %v, want 1.3s", clock.Now().Sub(start))
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	clock := newFakeClock()
+	c := New(WithClock(clock))
+	if c.clock != clock || c.Manager.(*DataManager).clock != clock {
+		t.Error("the clock of the client or of its manager is not replaced")
+	}
+	if c.NewManager().(*DataManager).clock != clock {
+		t.Error("the clock is not shared with a new manager")
+	}
+	WithClock(nil)(c)
+	if _, ok := c.Manager.(*DataManager).clock.(wallClock); !ok {
+		t.Error("nil does not restore the wall clock")
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"errors"
 	"github.com/showwin/speedtest-go/speedtest/internal"
 	"io"
+	"log/slog"
 	"math"
+	"math/rand/v2"
 	"runtime"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,6 +19,13 @@ import (
 type Manager interface {
 	SetRateCaptureFrequency(duration time.Duration) Manager
 	SetCaptureTime(duration time.Duration) Manager
+	SetDownloadStopPolicy(policy StopPolicy) Manager
+	SetUploadStopPolicy(policy StopPolicy) Manager
+	SetWarmUp(duration time.Duration) Manager
+	SetAdaptiveThreads(adaptive *AdaptiveThreads) Manager
+	SetDataBudget(budget *DataBudget) Manager
+	SetUploadPayload(payload Payload) Manager
+	GetDataBudget() *DataBudget
 
 	NewChunk() Chunk
 
@@ -69,6 +79,80 @@ var (
 	ErrorUninitializedManager = errors.New("uninitialized manager")
 )
 
+// StopMode selects how a transfer test decides to end.
+type StopMode int
+
+const (
+	StopAuto     StopMode = iota // stop once the rate is stable, at the latest after the capture time
+	StopDuration                 // run for exactly the given duration
+	StopVolume                   // stop after transferring the given volume
+)
+
+func (m StopMode) String() string {
+	switch m {
+	case StopDuration:
+		return "duration"
+	case StopVolume:
+		return "volume"
+	default:
+		return "auto"
+	}
+}
+
+// StopPolicy decides when a download or upload test ends.
+type StopPolicy struct {
+	Mode StopMode
+	// Duration of the test, the capture time is used if zero.
+	// In StopVolume mode it is an upper bound, MaxVolumeDuration if zero.
+	Duration time.Duration
+	Bytes    int64 // volume of StopVolume mode
+}
+
+// MaxVolumeDuration ends a StopVolume test without Duration whose volume is
+// not reached in time, the test stops with StopTimeout.
+const MaxVolumeDuration = 10 * time.Minute
+
+// WarmUpAuto ends the warm-up once the rate stops growing, see SetWarmUp.
+const WarmUpAuto time.Duration = -1
+
+const maxAutoWarmUp = 5 * time.Second
+
+// TransferStats describes how a download or upload test went.
+type TransferStats struct {
+	WarmUp          time.Duration     `json:"warm_up"` // excluded from the reported rate
+	Connections     int               `json:"connections"`
+	ConnectionCurve []ConnectionPoint `json:"connection_curve,omitempty"` // of the adaptive connection scaling
+	Quality         Quality           `json:"quality"`
+}
+
+// ConnectionPoint is the aggregate throughput measured with a number of connections.
+type ConnectionPoint struct {
+	Connections int      `json:"connections"`
+	Rate        ByteRate `json:"rate"`
+}
+
+// AdaptiveThreads scales the number of connections of a test: it starts with
+// Initial connections and adds Step more every Interval, as long as the
+// aggregate throughput grows by at least Threshold (0.1 is 10%), up to Max.
+type AdaptiveThreads struct {
+	Initial   int
+	Step      int
+	Max       int
+	Threshold float64
+	Interval  time.Duration
+}
+
+// DefaultAdaptiveThreads returns the adaptive scaling used when a field is left zero.
+func DefaultAdaptiveThreads() *AdaptiveThreads {
+	return &AdaptiveThreads{
+		Initial:   2,
+		Step:      2,
+		Max:       64,
+		Threshold: 0.1,
+		Interval:  time.Second,
+	}
+}
+
 type funcGroup struct {
 	fns []func()
 }
@@ -83,33 +167,61 @@ type DataManager struct {
 	sync.Mutex
 
 	repeatByte *[]byte
+	payload    Payload
+	logger     *slog.Logger
+	clock      Clock
 
 	captureTime          time.Duration
 	rateCaptureFrequency time.Duration
+	downloadStopPolicy   StopPolicy
+	uploadStopPolicy     StopPolicy
+	warmUp               time.Duration
+	adaptiveThreads      *AdaptiveThreads
+	budget               *DataBudget
 	nThread              int
 
-	running   bool
-	runningRW sync.RWMutex
-
 	download *TestDirection
 	upload   *TestDirection
 }
 
 type TestDirection struct {
-	TestType        int                         // test type
-	manager         *DataManager                // manager
-	totalDataVolume int64                       // total send/receive data volume
-	RateSequence    []int64                     // rate history sequence
+	TestType        int                        // test type
+	manager         *DataManager               // manager
+	totalDataVolume int64                      // total send/receive data volume
+	budget          atomic.Pointer[DataBudget] // of the running test, nil if unlimited
+	running         bool                       // the test is running, each direction runs on its own
+	runningRW       sync.RWMutex
+	onTick          func(bytes, delta int64, rate ByteRate, warmUp bool) // event hook of the running test, set before Start
+	*funcGroup                                                           // actually exec function
+
+	// mu guards the fields below, written by the capture, scaling and
+	// stopping goroutines while a test is running.
+	mu              sync.Mutex
+	RateSequence    []int64                     // rate history sequence, see Rates while a test is running
 	welford         *internal.Welford           // std/EWMA/mean
+	policy          StopPolicy                  // stop condition
+	startTime       time.Time                   // start of the capture, after the warm-up
+	endTime         time.Time                   // end of the capture
+	warmUp          time.Duration               // duration of the warm-up
+	baseVolume      int64                       // data volume before the measured part
+	connections     int                         // number of connections started
+	connectionCurve []ConnectionPoint           // throughput of each scaling step
+	stopReason      StopReason                  // why the last test ended
+	stable          bool                        // the last rate sample was stable
+	samples         int                         // rate samples of the measured part
 	captureCallback func(realTimeRate ByteRate) // user callback
-	closeFunc       func()                      // close func
-	*funcGroup                                  // actually exec function
+	closeFunc       func(reason StopReason)     // ends the running test
 }
 
 func (dm *DataManager) NewDataDirection(testType int) *TestDirection {
+	policy := dm.downloadStopPolicy
+	if testType == typeUpload {
+		policy = dm.uploadStopPolicy
+	}
 	return &TestDirection{
 		TestType:  testType,
 		manager:   dm,
+		policy:    policy,
 		funcGroup: &funcGroup{},
 	}
 }
@@ -122,6 +234,8 @@ func NewDataManager() *DataManager {
 		rateCaptureFrequency: time.Millisecond * 50,
 		Snapshot:             &Snapshot{},
 		repeatByte:           &r,
+		logger:               discardLogger,
+		clock:                wallClock{},
 	}
 	ret.download = ret.NewDataDirection(typeDownload)
 	ret.upload = ret.NewDataDirection(typeUpload)
@@ -129,23 +243,83 @@ func NewDataManager() *DataManager {
 	return ret
 }
 
-func (dm *DataManager) SetCallbackDownload(callback func(downRate ByteRate)) {
-	if dm.download != nil {
-		dm.download.captureCallback = callback
+// Fork returns a new manager with the settings of dm and none of its test
+// data, the tests of the fork do not share any state with the tests of dm.
+// The data budget, the logger and the clock are shared.
+func (dm *DataManager) Fork() *DataManager {
+	dm.Lock()
+	defer dm.Unlock()
+	ret := &DataManager{
+		nThread:              dm.nThread,
+		captureTime:          dm.captureTime,
+		rateCaptureFrequency: dm.rateCaptureFrequency,
+		downloadStopPolicy:   dm.downloadStopPolicy,
+		uploadStopPolicy:     dm.uploadStopPolicy,
+		warmUp:               dm.warmUp,
+		adaptiveThreads:      dm.adaptiveThreads,
+		budget:               dm.budget,
+		payload:              dm.payload,
+		Snapshot:             &Snapshot{},
+		repeatByte:           dm.repeatByte,
+		logger:               dm.logger,
+		clock:                dm.clock,
+	}
+	ret.download = ret.NewDataDirection(typeDownload)
+	ret.upload = ret.NewDataDirection(typeUpload)
+	ret.SnapshotStore = newHistorySnapshots(maxSnapshotSize)
+	return ret
+}
+
+// testSettings are the settings of the manager taken when a test starts.
+type testSettings struct {
+	nThread     int
+	captureTime time.Duration
+	frequency   time.Duration
+	warmUp      time.Duration
+	adaptive    *AdaptiveThreads
+	budget      *DataBudget
+	clock       Clock
+}
+
+// settings returns the current settings, the caller holds dm.Mutex.
+func (dm *DataManager) settings() testSettings {
+	return testSettings{
+		nThread:     dm.nThread,
+		captureTime: dm.captureTime,
+		frequency:   dm.rateCaptureFrequency,
+		warmUp:      dm.warmUp,
+		adaptive:    dm.adaptiveThreads,
+		budget:      dm.budget,
+		clock:       dm.clock,
 	}
 }
 
-func (dm *DataManager) SetCallbackUpload(callback func(upRate ByteRate)) {
-	if dm.upload != nil {
-		dm.upload.captureCallback = callback
+// direction returns the download or upload direction, Reset replaces them.
+func (dm *DataManager) direction(testType int) *TestDirection {
+	dm.Lock()
+	defer dm.Unlock()
+	if testType == typeUpload {
+		return dm.upload
 	}
+	return dm.download
+}
+
+func (dm *DataManager) SetCallbackDownload(callback func(downRate ByteRate)) {
+	dm.direction(typeDownload).setCallback(callback)
+}
+
+func (dm *DataManager) SetCallbackUpload(callback func(upRate ByteRate)) {
+	dm.direction(typeUpload).setCallback(callback)
 }
 
 func (dm *DataManager) Wait() {
 	oldDownTotal := dm.GetTotalDownload()
 	oldUpTotal := dm.GetTotalUpload()
+	dm.Lock()
+	frequency, clock := dm.rateCaptureFrequency, dm.clock
+	dm.Unlock()
 	for {
-		time.Sleep(dm.rateCaptureFrequency)
+		<-clock.After(frequency)
 		newDownTotal := dm.GetTotalDownload()
 		newUpTotal := dm.GetTotalUpload()
 		deltaDown := newDownTotal - oldDownTotal
@@ -159,6 +333,8 @@ func (dm *DataManager) Wait() {
 }
 
 func (dm *DataManager) RegisterUploadHandler(fn func()) *TestDirection {
+	dm.Lock()
+	defer dm.Unlock()
 	if len(dm.upload.fns) < dm.nThread {
 		dm.upload.Add(fn)
 	}
@@ -166,6 +342,8 @@ func (dm *DataManager) RegisterUploadHandler(fn func()) *TestDirection {
 }
 
 func (dm *DataManager) RegisterDownloadHandler(fn func()) *TestDirection {
+	dm.Lock()
+	defer dm.Unlock()
 	if len(dm.download.fns) < dm.nThread {
 		dm.download.Add(fn)
 	}
@@ -181,160 +359,504 @@ func (td *TestDirection) AddTotalDataVolume(delta int64) int64 {
 }
 
 func (td *TestDirection) Start(cancel context.CancelFunc, mainRequestHandlerIndex int) {
-	if len(td.fns) == 0 {
+	td.StartContext(context.Background(), cancel, mainRequestHandlerIndex)
+}
+
+// StartContext is Start ending the test once ctx is done, with the StopCanceled reason.
+// It returns once the connections, the rate capture and the stop of the test are done,
+// so the statistics of the direction are complete and no callback runs afterward.
+func (td *TestDirection) StartContext(ctx context.Context, cancel context.CancelFunc, mainRequestHandlerIndex int) {
+	dm := td.manager
+	dm.Lock()
+	fns := td.fns
+	td.funcGroup = &funcGroup{} // the handlers are registered for a single run
+	settings := dm.settings()
+	dm.Unlock()
+	if len(fns) == 0 {
 		panic("empty task stack")
 	}
-	if mainRequestHandlerIndex > len(td.fns)-1 {
+	if mainRequestHandlerIndex > len(fns)-1 {
 		mainRequestHandlerIndex = 0
 	}
 	mainLoadFactor := 0.1
 	// When the number of processor cores is equivalent to the processing program,
 	// the processing efficiency reaches the highest level (VT is not considered).
-	mainN := int(mainLoadFactor * float64(len(td.fns)))
+	mainN := int(mainLoadFactor * float64(len(fns)))
 	if mainN == 0 {
 		mainN = 1
 	}
-	if len(td.fns) == 1 {
-		mainN = td.manager.nThread
+	if len(fns) == 1 {
+		mainN = settings.nThread
 	}
-	auxN := td.manager.nThread - mainN
-	dbg.Printf("Available fns: %d\n", len(td.fns))
-	dbg.Printf("mainN: %d\n", mainN)
-	dbg.Printf("auxN: %d\n", auxN)
+	auxN := settings.nThread - mainN
+	dm.logger.Debug("test started", "phase", td.phase(), "fns", len(fns), "main", mainN, "aux", auxN)
 	wg := sync.WaitGroup{}
-	td.manager.running = true
-	stopCapture := td.rateCapture()
+	if settings.budget != nil {
+		dm.logger.Debug("data budget", "phase", td.phase(), "bytes", settings.budget.Remaining(td.phase()))
+	}
+	td.budget.Store(settings.budget)
+	stopCapture := make(chan struct{})
+	captureDone := make(chan struct{})
+	stopScaling := make(chan struct{})
+	stopped := make(chan struct{})
 
 	// refresh once function
 	once := sync.Once{}
-	td.closeFunc = func() {
+	closeFunc := func(reason StopReason) {
 		once.Do(func() {
-			stopCapture <- true
+			defer close(stopped)
 			close(stopCapture)
-			td.manager.runningRW.Lock()
-			td.manager.running = false
-			td.manager.runningRW.Unlock()
+			<-captureDone
+			close(stopScaling)
+			td.mu.Lock()
+			td.stopReason = reason
+			td.endTime = settings.clock.Now()
+			td.mu.Unlock()
+			td.runningRW.Lock()
+			td.running = false
+			td.runningRW.Unlock()
 			cancel()
-			dbg.Println("FuncGroup: Stop")
+			dm.logger.Debug("test stopped", "phase", td.phase(), "reason", reason)
 		})
 	}
-
-	time.AfterFunc(td.manager.captureTime, td.closeFunc)
-	for i := 0; i < mainN; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				td.manager.runningRW.RLock()
-				running := td.manager.running
-				td.manager.runningRW.RUnlock()
-				if !running {
-					return
-				}
-				td.fns[mainRequestHandlerIndex]()
-			}
-		}()
-	}
-	for j := 0; j < auxN; {
-		for i := range td.fns {
-			if j == auxN {
-				break
-			}
-			if i == mainRequestHandlerIndex {
-				continue
-			}
+	td.mu.Lock()
+	td.warmUp, td.connections, td.connectionCurve = 0, 0, nil
+	td.stopReason, td.stable, td.samples = "", false, 0
+	td.startTime, td.endTime = time.Time{}, time.Time{}
+	td.closeFunc = closeFunc
+	td.mu.Unlock()
+	td.runningRW.Lock()
+	td.running = true
+	td.runningRW.Unlock()
+	td.rateCapture(settings, closeFunc, stopCapture, captureDone)
+	stopWatch := context.AfterFunc(ctx, func() { closeFunc(StopCanceled) })
+	defer stopWatch()
+
+	// launch starts n more connections, each one running its request handler until the test ends
+	launch := func(n int) {
+		td.mu.Lock()
+		defer td.mu.Unlock()
+		for ; n > 0; n-- {
+			fn := fns[td.handlerIndex(len(fns), td.connections, mainN, mainRequestHandlerIndex)]
+			td.connections++
 			wg.Add(1)
-			t := i
 			go func() {
 				defer wg.Done()
-				for {
-					td.manager.runningRW.RLock()
-					running := td.manager.running
-					td.manager.runningRW.RUnlock()
-					if !running {
-						return
-					}
-					td.fns[t]()
+				for td.isRunning() {
+					fn()
 				}
 			}()
-			j++
 		}
 	}
+	if adaptive := settings.adaptive; adaptive != nil {
+		launch(adaptive.Initial)
+		wg.Add(1)
+		go td.scaleConnections(settings.clock, adaptive, launch, stopScaling, &wg)
+	} else {
+		launch(mainN + auxN)
+	}
 	wg.Wait()
+	<-stopped
+}
+
+func (td *TestDirection) isRunning() bool {
+	td.runningRW.RLock()
+	defer td.runningRW.RUnlock()
+	return td.running
+}
+
+// stop ends the running test with the reason, if any.
+func (td *TestDirection) stop(reason StopReason) {
+	td.mu.Lock()
+	closeFunc := td.closeFunc
+	td.mu.Unlock()
+	if closeFunc != nil {
+		closeFunc(reason)
+	}
+}
+
+func (td *TestDirection) phase() Phase {
+	if td.TestType == typeUpload {
+		return PhaseUpload
+	}
+	return PhaseDownload
 }
 
-func (td *TestDirection) rateCapture() chan bool {
-	ticker := time.NewTicker(td.manager.rateCaptureFrequency)
-	var prevTotalDataVolume int64 = 0
-	stopCapture := make(chan bool)
-	td.welford = internal.NewWelford(5*time.Second, td.manager.rateCaptureFrequency)
-	sTime := time.Now()
-	go func(t *time.Ticker) {
+// reserve takes up to n bytes from the data budget of the running test, shared
+// with the other tests of its phase. It returns 0 once the budget is spent and
+// ends the test.
+func (td *TestDirection) reserve(n int) int {
+	budget := td.budget.Load()
+	if budget == nil {
+		return n
+	}
+	k := int(budget.reserve(td.phase(), int64(n)))
+	if k == 0 {
+		go td.stop(StopBudget)
+	}
+	return k
+}
+
+// release gives back a reservation once its bytes are read from or handed to
+// the connection, the meter of the test counts them from there.
+func (td *TestDirection) release(n int) {
+	if budget := td.budget.Load(); budget != nil && n > 0 {
+		budget.release(td.phase(), int64(n))
+	}
+}
+
+// handlerIndex maps the k-th of the connections to one of the n request handlers: the
+// first mainN run the main handler, the others are spread over the auxiliary handlers.
+func (td *TestDirection) handlerIndex(n, k, mainN, mainRequestHandlerIndex int) int {
+	if k < mainN || n == 1 {
+		return mainRequestHandlerIndex
+	}
+	i := (k - mainN) % (n - 1)
+	if i >= mainRequestHandlerIndex {
+		i++
+	}
+	return i
+}
+
+// scaleConnections adds connections while each step raises the aggregate
+// throughput by the threshold, and records the throughput of each step.
+func (td *TestDirection) scaleConnections(clock Clock, adaptive *AdaptiveThreads, launch func(n int), stop chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := clock.NewTicker(adaptive.Interval)
+	defer ticker.Stop()
+	var prevVolume int64
+	var prevRate float64
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+		}
+		volume := td.GetTotalDataVolume()
+		rate := float64(volume-prevVolume) / adaptive.Interval.Seconds()
+		prevVolume = volume
+		td.mu.Lock()
+		connections := td.connections
+		td.connectionCurve = append(td.connectionCurve, ConnectionPoint{Connections: connections, Rate: ByteRate(rate)})
+		td.mu.Unlock()
+		td.manager.logger.Debug("connections scaled", "phase", td.phase(), "connections", connections, "rate", ByteRate(rate))
+		if prevRate > 0 && rate < prevRate*(1+adaptive.Threshold) {
+			return // the last step did not pay off
+		}
+		n := min(adaptive.Step, adaptive.Max-connections)
+		if n <= 0 {
+			return
+		}
+		prevRate = rate
+		select {
+		case <-stop:
+			return
+		default:
+			launch(n)
+		}
+	}
+}
+
+// startMeasure starts the measured part of the test, after the warm-up if any.
+// The caller holds td.mu.
+func (td *TestDirection) startMeasure(settings testSettings, closeFunc func(reason StopReason), baseVolume int64) {
+	td.startTime = settings.clock.Now()
+	td.baseVolume = baseVolume
+	timeout := td.policy.Duration
+	reason := StopTimeout
+	if td.policy.Mode != StopAuto {
+		reason = StopElapsed
+	}
+	if timeout <= 0 {
+		timeout = settings.captureTime
+		if td.policy.Mode == StopVolume {
+			// a stalled server never delivers the volume
+			timeout, reason = MaxVolumeDuration, StopTimeout
+		}
+	}
+	if timeout > 0 {
+		settings.clock.AfterFunc(timeout, func() { closeFunc(reason) })
+	}
+}
+
+// rateCapture samples the data volume at the capture frequency until stopCapture
+// is closed, then closes captureDone.
+func (td *TestDirection) rateCapture(settings testSettings, closeFunc func(reason StopReason), stopCapture, captureDone chan struct{}) {
+	frequency := settings.frequency
+	clock := settings.clock
+	ticker := clock.NewTicker(frequency)
+	prevTotalDataVolume := td.GetTotalDataVolume() // the direction may be reused without a reset
+	startVolume := prevTotalDataVolume
+	var warmUp *internal.WarmUp
+	switch {
+	case settings.warmUp == WarmUpAuto:
+		warmUp = internal.NewWarmUp(0, maxAutoWarmUp, frequency)
+	case settings.warmUp > 0:
+		warmUp = internal.NewWarmUp(settings.warmUp, settings.warmUp, frequency)
+	}
+	wTime := clock.Now()
+	td.mu.Lock()
+	td.welford = internal.NewWelford(5*time.Second, frequency)
+	if warmUp == nil {
+		td.startMeasure(settings, closeFunc, prevTotalDataVolume)
+	}
+	td.mu.Unlock()
+	go func(t Ticker) {
+		defer close(captureDone)
 		defer t.Stop()
 		for {
 			select {
-			case <-t.C:
-				newTotalDataVolume := td.GetTotalDataVolume()
-				deltaDataVolume := newTotalDataVolume - prevTotalDataVolume
-				prevTotalDataVolume = newTotalDataVolume
-				if deltaDataVolume != 0 {
-					td.RateSequence = append(td.RateSequence, deltaDataVolume)
+			case <-t.C():
+			case <-stopCapture:
+				return
+			}
+			newTotalDataVolume := td.GetTotalDataVolume()
+			deltaDataVolume := newTotalDataVolume - prevTotalDataVolume
+			prevTotalDataVolume = newTotalDataVolume
+			td.mu.Lock()
+			if deltaDataVolume != 0 {
+				td.RateSequence = append(td.RateSequence, deltaDataVolume)
+			}
+			callback, warming := td.captureCallback, warmUp != nil
+			var rate ByteRate
+			var stop StopReason // the test is over, the capture ends with this sample
+			// the warm-up samples stay in the sequence but are kept out of the measuring instrument
+			if warming {
+				if elapsed := clock.Now().Sub(wTime); warmUp.Update(float64(deltaDataVolume), elapsed) {
+					td.warmUp = elapsed
+					td.manager.logger.Debug("warm-up ended", "phase", td.phase(), "warm_up", td.warmUp)
+					warmUp = nil
+					td.startMeasure(settings, closeFunc, newTotalDataVolume)
 				}
+				rate = ByteRate(float64(deltaDataVolume) / frequency.Seconds())
+			} else {
 				// anyway we update the measuring instrument
-				globalAvg := (float64(td.GetTotalDataVolume())) / float64(time.Since(sTime).Milliseconds()) * 1000
-				if td.welford.Update(globalAvg, float64(deltaDataVolume)) {
-					go td.closeFunc()
-				}
-				// reports the current rate at the given rate
-				if td.captureCallback != nil {
-					td.captureCallback(ByteRate(td.welford.EWMA()))
-				}
-			case stop := <-stopCapture:
-				if stop {
-					return
+				measuredDataVolume := newTotalDataVolume - td.baseVolume
+				globalAvg := (float64(measuredDataVolume)) / float64(clock.Now().Sub(td.startTime).Milliseconds()) * 1000
+				td.stable = td.welford.Update(globalAvg, float64(deltaDataVolume))
+				td.samples++
+				switch td.policy.Mode {
+				case StopAuto:
+					if td.stable {
+						stop = StopConverged
+					}
+				case StopVolume:
+					if measuredDataVolume >= td.policy.Bytes {
+						stop = StopReached
+					}
 				}
+				rate = ByteRate(td.welford.EWMA())
+			}
+			td.mu.Unlock()
+			// reports the current rate at the given rate
+			if callback != nil {
+				callback(rate)
+			}
+			if td.onTick != nil {
+				td.onTick(newTotalDataVolume-startVolume, deltaDataVolume, rate, warming)
+			}
+			if stop != "" {
+				go closeFunc(stop) // it waits for captureDone
+				return
 			}
 		}
 	}(ticker)
-	return stopCapture
+}
+
+// Rates returns a copy of the rate sequence, it may be called while a test is running.
+func (td *TestDirection) Rates() []int64 {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	return slices.Clone(td.RateSequence)
+}
+
+// Stats returns the statistics of the last test run in this direction,
+// the request counts of the quality are left to the caller.
+func (td *TestDirection) Stats() TransferStats {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	stats := TransferStats{
+		WarmUp:          td.warmUp,
+		Connections:     td.connections,
+		ConnectionCurve: slices.Clone(td.connectionCurve),
+		Quality: Quality{
+			StopReason: td.stopReason,
+			Converged:  td.stable,
+			Samples:    td.samples,
+		},
+	}
+	if td.welford != nil {
+		stats.Quality.CV = td.welford.CV()
+	}
+	stats.Quality.Grade = stats.Quality.grade()
+	return stats
+}
+
+// Rate returns the measured rate in bytes per second: the EWMA in StopAuto
+// mode, the average over the whole capture in the fixed modes.
+func (td *TestDirection) Rate() float64 {
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	if td.policy.Mode == StopAuto {
+		return td.ewma()
+	}
+	elapsed := td.endTime.Sub(td.startTime)
+	if td.startTime.IsZero() || elapsed <= 0 {
+		return 0
+	}
+	return float64(td.GetTotalDataVolume()-td.baseVolume) / elapsed.Seconds()
+}
+
+// ewma returns the EWMA rate of the last test, the caller holds td.mu.
+func (td *TestDirection) ewma() float64 {
+	if td.welford == nil {
+		return 0
+	}
+	return td.welford.EWMA()
+}
+
+func (td *TestDirection) setCallback(callback func(rate ByteRate)) {
+	td.mu.Lock()
+	td.captureCallback = callback
+	td.mu.Unlock()
+}
+
+func (td *TestDirection) setPolicy(policy StopPolicy) {
+	td.mu.Lock()
+	td.policy = policy
+	td.mu.Unlock()
 }
 
 func (dm *DataManager) NewChunk() Chunk {
 	var dc DataChunk
 	dc.manager = dm
 	dm.Lock()
+	dc.clock = dm.clock
 	*dm.Snapshot = append(*dm.Snapshot, &dc)
 	dm.Unlock()
 	return &dc
 }
 
 func (dm *DataManager) AddTotalDownload(value int64) {
-	dm.download.AddTotalDataVolume(value)
+	dm.direction(typeDownload).AddTotalDataVolume(value)
 }
 
 func (dm *DataManager) AddTotalUpload(value int64) {
-	dm.upload.AddTotalDataVolume(value)
+	dm.direction(typeUpload).AddTotalDataVolume(value)
 }
 
 func (dm *DataManager) GetTotalDownload() int64 {
-	return dm.download.GetTotalDataVolume()
+	return dm.direction(typeDownload).GetTotalDataVolume()
 }
 
 func (dm *DataManager) GetTotalUpload() int64 {
-	return dm.upload.GetTotalDataVolume()
+	return dm.direction(typeUpload).GetTotalDataVolume()
 }
 
 func (dm *DataManager) SetRateCaptureFrequency(duration time.Duration) Manager {
+	dm.Lock()
+	defer dm.Unlock()
 	dm.rateCaptureFrequency = duration
 	return dm
 }
 
 func (dm *DataManager) SetCaptureTime(duration time.Duration) Manager {
+	dm.Lock()
+	defer dm.Unlock()
 	dm.captureTime = duration
 	return dm
 }
 
+// SetDownloadStopPolicy sets when the download tests end, from the next test on.
+func (dm *DataManager) SetDownloadStopPolicy(policy StopPolicy) Manager {
+	dm.Lock()
+	dm.downloadStopPolicy = policy
+	td := dm.download
+	dm.Unlock()
+	td.setPolicy(policy)
+	return dm
+}
+
+// SetUploadStopPolicy sets when the upload tests end, from the next test on.
+func (dm *DataManager) SetUploadStopPolicy(policy StopPolicy) Manager {
+	dm.Lock()
+	dm.uploadStopPolicy = policy
+	td := dm.upload
+	dm.Unlock()
+	td.setPolicy(policy)
+	return dm
+}
+
+// SetWarmUp excludes the TCP slow start from the reported rates: the samples of the
+// first duration of each test, or until the rate stops growing with WarmUpAuto,
+// are kept in the rate sequence only. The stop policy applies after the warm-up.
+// Zero disables the warm-up.
+func (dm *DataManager) SetWarmUp(duration time.Duration) Manager {
+	dm.Lock()
+	defer dm.Unlock()
+	dm.warmUp = duration
+	return dm
+}
+
+// SetAdaptiveThreads replaces the fixed number of connections with the
+// adaptive scaling, nil restores the fixed number of SetNThread.
+func (dm *DataManager) SetAdaptiveThreads(adaptive *AdaptiveThreads) Manager {
+	dm.Lock()
+	defer dm.Unlock()
+	if adaptive == nil {
+		dm.adaptiveThreads = nil
+		return dm
+	}
+	a := *adaptive
+	def := DefaultAdaptiveThreads()
+	if a.Initial < 1 {
+		a.Initial = def.Initial
+	}
+	if a.Step < 1 {
+		a.Step = def.Step
+	}
+	if a.Max < 1 {
+		a.Max = def.Max
+	}
+	if a.Max < a.Initial {
+		a.Initial = a.Max
+	}
+	if a.Threshold <= 0 {
+		a.Threshold = def.Threshold
+	}
+	if a.Interval <= 0 {
+		a.Interval = def.Interval
+	}
+	dm.adaptiveThreads = &a
+	return dm
+}
+
+// SetDataBudget caps the download and upload tests to the allotments of the
+// budget, nil removes the cap.
+func (dm *DataManager) SetDataBudget(budget *DataBudget) Manager {
+	dm.Lock()
+	defer dm.Unlock()
+	dm.budget = budget
+	return dm
+}
+
+func (dm *DataManager) GetDataBudget() *DataBudget {
+	dm.Lock()
+	defer dm.Unlock()
+	return dm.budget
+}
+
+// SetUploadPayload selects the bytes of the upload bodies, PayloadRandom by default.
+func (dm *DataManager) SetUploadPayload(payload Payload) Manager {
+	dm.Lock()
+	defer dm.Unlock()
+	dm.payload = payload
+	return dm
+}
+
 func (dm *DataManager) SetNThread(n int) Manager {
+	dm.Lock()
+	defer dm.Unlock()
 	if n < 1 {
 		dm.nThread = runtime.NumCPU()
 	} else {
@@ -343,11 +865,27 @@ func (dm *DataManager) SetNThread(n int) Manager {
 	return dm
 }
 
+// SetClock replaces the wall clock of the rate capture and the stop
+// criteria, from the next test on. nil restores the wall clock.
+func (dm *DataManager) SetClock(clock Clock) Manager {
+	dm.Lock()
+	defer dm.Unlock()
+	if clock == nil {
+		clock = wallClock{}
+	}
+	dm.clock = clock
+	return dm
+}
+
 func (dm *DataManager) Snapshots() *Snapshots {
 	return dm.SnapshotStore
 }
 
+// Reset starts new download and upload directions, the handlers still running
+// keep counting into the directions of their test.
 func (dm *DataManager) Reset() {
+	dm.Lock()
+	defer dm.Unlock()
 	dm.SnapshotStore.push(dm.Snapshot)
 	dm.Snapshot = &Snapshot{}
 	dm.download = dm.NewDataDirection(typeDownload)
@@ -355,37 +893,47 @@ func (dm *DataManager) Reset() {
 }
 
 func (dm *DataManager) GetAvgDownloadRate() float64 {
-	unit := float64(dm.captureTime / time.Millisecond)
-	return float64(dm.download.GetTotalDataVolume()*8/1000) / unit
+	return dm.avgRate(typeDownload)
 }
 
 func (dm *DataManager) GetEWMADownloadRate() float64 {
-	if dm.download.welford != nil {
-		return dm.download.welford.EWMA()
-	}
-	return 0
+	return dm.ewmaRate(typeDownload)
 }
 
 func (dm *DataManager) GetAvgUploadRate() float64 {
-	unit := float64(dm.captureTime / time.Millisecond)
-	return float64(dm.upload.GetTotalDataVolume()*8/1000) / unit
+	return dm.avgRate(typeUpload)
 }
 
 func (dm *DataManager) GetEWMAUploadRate() float64 {
-	if dm.upload.welford != nil {
-		return dm.upload.welford.EWMA()
-	}
-	return 0
+	return dm.ewmaRate(typeUpload)
+}
+
+func (dm *DataManager) avgRate(testType int) float64 {
+	dm.Lock()
+	unit := float64(dm.captureTime / time.Millisecond)
+	dm.Unlock()
+	return float64(dm.direction(testType).GetTotalDataVolume()*8/1000) / unit
+}
+
+func (dm *DataManager) ewmaRate(testType int) float64 {
+	td := dm.direction(testType)
+	td.mu.Lock()
+	defer td.mu.Unlock()
+	return td.ewma()
 }
 
 type DataChunk struct {
 	manager             *DataManager
+	direction           *TestDirection // of the test the chunk belongs to, Reset does not move it
+	payload             Payload
+	clock               Clock
 	dateType            DataType
 	startTime           time.Time
 	endTime             time.Time
 	err                 error
 	ContentLength       int64
 	remainOrDiscardSize int64
+	offset              int64 // of the upload body in the payload
 }
 
 var blackHolePool = sync.Pool{
@@ -416,25 +964,28 @@ func (dc *DataChunk) DownloadHandler(r io.Reader) error {
 		return dc.err
 	}
 	dc.dateType = typeDownload
-	dc.startTime = time.Now()
+	dc.direction = dc.manager.direction(typeDownload)
+	dc.startTime = dc.clock.Now()
 	defer func() {
-		dc.endTime = time.Now()
+		dc.endTime = dc.clock.Now()
 	}()
 	bufP := blackHolePool.Get().(*[]byte)
 	defer blackHolePool.Put(bufP)
 	readSize := 0
 	for {
-		dc.manager.runningRW.RLock()
-		running := dc.manager.running
-		dc.manager.runningRW.RUnlock()
-		if !running {
+		if !dc.direction.isRunning() {
 			return nil
 		}
-		readSize, dc.err = r.Read(*bufP)
+		reserved := dc.direction.reserve(len(*bufP))
+		if reserved == 0 {
+			return nil // the data budget is spent
+		}
+		readSize, dc.err = r.Read((*bufP)[:reserved])
+		dc.direction.release(reserved)
 		rs := int64(readSize)
 
 		dc.remainOrDiscardSize += rs
-		dc.manager.download.AddTotalDataVolume(rs)
+		dc.direction.AddTotalDataVolume(rs)
 		if dc.err != nil {
 			if dc.err == io.EOF {
 				return nil
@@ -455,8 +1006,13 @@ func (dc *DataChunk) UploadHandler(size int64) Chunk {
 
 	dc.ContentLength = size
 	dc.remainOrDiscardSize = size
+	dc.offset = rand.Int64N(randomPoolSize)
 	dc.dateType = typeUpload
-	dc.startTime = time.Now()
+	dc.direction = dc.manager.direction(typeUpload)
+	dc.manager.Lock()
+	dc.payload = dc.manager.payload
+	dc.manager.Unlock()
+	dc.startTime = dc.clock.Now()
 	return dc
 }
 
@@ -465,18 +1021,23 @@ func (dc *DataChunk) GetParent() Manager {
 }
 
 func (dc *DataChunk) Read(b []byte) (n int, err error) {
-	if dc.remainOrDiscardSize < readChunkSize {
-		if dc.remainOrDiscardSize <= 0 {
-			dc.endTime = time.Now()
-			return n, io.EOF
-		}
-		n = copy(b, (*dc.manager.repeatByte)[:dc.remainOrDiscardSize])
-	} else {
-		n = copy(b, *dc.manager.repeatByte)
+	if dc.remainOrDiscardSize <= 0 {
+		dc.endTime = dc.clock.Now()
+		return n, io.EOF
+	}
+	size := min(dc.remainOrDiscardSize, readChunkSize)
+	reserved := dc.direction.reserve(int(size))
+	if reserved == 0 {
+		dc.endTime = dc.clock.Now()
+		return n, io.EOF // the data budget is spent
 	}
+	src := dc.payloadAt()
+	n = copy(b, src[:min(reserved, len(src))])
+	dc.direction.release(reserved)
 	n64 := int64(n)
+	dc.offset += n64
 	dc.remainOrDiscardSize -= n64
-	dc.manager.AddTotalUpload(n64)
+	dc.direction.AddTotalDataVolume(n64)
 	return
 }
 
@@ -505,9 +1066,6 @@ func _(list []int64) float64 {
 }
 
 func pautaFilter(vector []int64) []int64 {
-	dbg.Println("Per capture unit")
-	dbg.Printf("Raw Sequence len: %d\n", len(vector))
-	dbg.Printf("Raw Sequence: %v\n", vector)
 	if len(vector) == 0 {
 		return vector
 	}
@@ -518,9 +1076,6 @@ func pautaFilter(vector []int64) []int64 {
 			retVec = append(retVec, value)
 		}
 	}
-	dbg.Printf("Raw average: %dByte\n", mean)
-	dbg.Printf("Pauta Sequence len: %d\n", len(retVec))
-	dbg.Printf("Pauta Sequence: %v\n", retVec)
 	return retVec
 }
 
@@ -1,7 +1,13 @@
 package speedtest
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
@@ -98,3 +104,365 @@ func TestDynamicRate(t *testing.T) {
 		fmt.Println("Warning: result seems to be wrong. Please test again.")
 	}
 }
+
+func TestStopPolicy(t *testing.T) {
+	ts := newSpeedtestStandIn(256 * 1024)
+	defer ts.Close()
+
+	c := New(WithDoer(&http.Client{}))
+	c.SetCaptureTime(10 * time.Second)
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetDownloadStopPolicy(StopPolicy{Mode: StopDuration, Duration: time.Second})
+	if err = server.DownloadTest(); err != nil {
+		t.Fatal(err)
+	}
+	if d := *server.TestDuration.Download; d < time.Second || d > 3*time.Second {
+		t.Errorf("got download duration %v, expected about 1s", d)
+	}
+	if server.DLSpeed <= 0 {
+		t.Errorf("got unexpected download speed %v", server.DLSpeed)
+	}
+	if q := server.DLStats.Quality; q.StopReason != StopElapsed || q.Samples == 0 || q.Requests == 0 || len(q.Grade) == 0 {
+		t.Errorf("got unexpected download quality %+v", q)
+	}
+
+	const volume = 8 * MB
+	c.SetUploadStopPolicy(StopPolicy{Mode: StopVolume, Bytes: volume})
+	if err = server.UploadTest(); err != nil {
+		t.Fatal(err)
+	}
+	if total := c.GetTotalUpload(); total < volume {
+		t.Errorf("got upload volume %d, expected at least %d", total, int64(volume))
+	}
+	if d := *server.TestDuration.Upload; d >= 10*time.Second {
+		t.Errorf("the upload test ran until the capture time %v", d)
+	}
+	if q := server.ULStats.Quality; q.StopReason != StopReached || q.Requests == 0 {
+		t.Errorf("got unexpected upload quality %+v", q)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	ts := newSpeedtestStandIn(256 * 1024)
+	defer ts.Close()
+
+	c := New(WithDoer(&http.Client{}))
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetWarmUp(500 * time.Millisecond)
+	c.SetDownloadStopPolicy(StopPolicy{Mode: StopDuration, Duration: time.Second})
+	if err = server.DownloadTest(); err != nil {
+		t.Fatal(err)
+	}
+	if w := server.DLStats.WarmUp; w < 500*time.Millisecond || w > time.Second {
+		t.Errorf("got warm-up %v, expected about 500ms", w)
+	}
+	// the test runs its duration after the warm-up
+	if d := *server.TestDuration.Download; d < 1500*time.Millisecond {
+		t.Errorf("got download duration %v, expected at least 1.5s", d)
+	}
+	if server.DLSpeed <= 0 {
+		t.Errorf("got unexpected download speed %v", server.DLSpeed)
+	}
+
+	c.SetWarmUp(WarmUpAuto)
+	c.SetUploadStopPolicy(StopPolicy{Mode: StopDuration, Duration: time.Second})
+	if err = server.UploadTest(); err != nil {
+		t.Fatal(err)
+	}
+	if w := server.ULStats.WarmUp; w <= 0 || w > maxAutoWarmUp+time.Second {
+		t.Errorf("got unexpected auto warm-up %v", w)
+	}
+}
+
+func TestAdaptiveThreads(t *testing.T) {
+	// each connection is throttled, so the throughput grows with the connections
+	chunk := make([]byte, 16*1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 16; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	c := New(WithDoer(&http.Client{}))
+	c.SetDownloadStopPolicy(StopPolicy{Mode: StopDuration, Duration: 2 * time.Second})
+	c.SetAdaptiveThreads(&AdaptiveThreads{Initial: 1, Step: 2, Max: 5, Interval: 300 * time.Millisecond})
+	server, err := c.CustomServer(ts.URL + "/speedtest/upload.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.DownloadTest(); err != nil {
+		t.Fatal(err)
+	}
+	stats := server.DLStats
+	if stats.Connections != 5 {
+		t.Errorf("got %d connections, expected 5, curve: %v", stats.Connections, stats.ConnectionCurve)
+	}
+	if len(stats.ConnectionCurve) < 3 {
+		t.Fatalf("got unexpected curve %v", stats.ConnectionCurve)
+	}
+	if first, last := stats.ConnectionCurve[0], stats.ConnectionCurve[len(stats.ConnectionCurve)-1]; last.Rate <= first.Rate {
+		t.Errorf("the throughput does not grow with the connections: %v", stats.ConnectionCurve)
+	}
+
+	// the fixed number of connections is reported too
+	c.SetAdaptiveThreads(nil)
+	c.SetNThread(3)
+	if err = server.DownloadTest(); err != nil {
+		t.Fatal(err)
+	}
+	if server.DLStats.Connections != 3 || server.DLStats.ConnectionCurve != nil {
+		t.Errorf("got unexpected stats %+v", server.DLStats)
+	}
+}
+
+func TestUploadPayload(t *testing.T) {
+	const size = 256 * 1024
+	compressed := func(payload Payload) int {
+		dm := NewDataManager()
+		dm.SetUploadPayload(payload)
+		body, err := io.ReadAll(dm.NewChunk().UploadHandler(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) != size {
+			t.Fatalf("got %d bytes of %s payload, expected %d", len(body), payload, size)
+		}
+		var buf bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		_, _ = w.Write(body)
+		_ = w.Close()
+		return buf.Len()
+	}
+	if n := compressed(PayloadRandom); n < size {
+		t.Errorf("the random payload compressed to %d bytes of %d", n, size)
+	}
+	if n := compressed(PayloadPattern); n > size/100 {
+		t.Errorf("the pattern payload compressed to %d bytes of %d", n, size)
+	}
+
+	for _, str := range []string{"random", "pattern"} {
+		if p, err := ParsePayload(str); err != nil || p.String() != str {
+			t.Errorf("got %v, %v parsing %s", p, err, str)
+		}
+	}
+	if _, err := ParsePayload("zeros"); err == nil {
+		t.Error("expected an error on an unknown payload")
+	}
+}
+
+func BenchmarkDataChunk_Read(b *testing.B) {
+	dm := NewDataManager()
+	buf := make([]byte, 32*1024)
+	b.SetBytes(readChunkSize)
+	b.ReportAllocs()
+	chunk := dm.NewChunk().UploadHandler(int64(b.N) * readChunkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = chunk.Read(buf)
+	}
+}
+
+// TestDataManagerStress runs many tests back-to-back against a local server
+// while the rates, totals and callbacks are read and replaced concurrently,
+// run it with -race.
+func TestDataManagerStress(t *testing.T) {
+	ts := newSpeedtestStandIn(64 * 1024)
+	defer ts.Close()
+
+	policies := []StopPolicy{
+		{Mode: StopAuto},
+		{Mode: StopDuration, Duration: 200 * time.Millisecond},
+		{Mode: StopVolume, Bytes: 1 * MB, Duration: time.Second},
+	}
+	var wg sync.WaitGroup
+	for client := 0; client < 2; client++ {
+		c := New()
+		c.SetCaptureTime(300 * time.Millisecond)
+		c.SetRateCaptureFrequency(10 * time.Millisecond)
+		c.SetNThread(4)
+		if client == 1 {
+			c.SetWarmUp(50 * time.Millisecond)
+			c.SetAdaptiveThreads(&AdaptiveThreads{Initial: 1, Step: 1, Max: 4, Interval: 50 * time.Millisecond})
+		}
+		server, err := c.CustomServer(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				c.GetEWMADownloadRate()
+				c.GetEWMAUploadRate()
+				c.GetAvgDownloadRate()
+				c.GetTotalUpload()
+				c.SetCallbackDownload(func(ByteRate) {})
+				c.SetCallbackUpload(func(ByteRate) {})
+				if dm, ok := c.Manager.(*DataManager); ok {
+					dm.direction(typeDownload).Rates()
+					dm.direction(typeUpload).Stats()
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			defer close(done)
+			for i := 0; i < 9; i++ {
+				policy := policies[i%len(policies)]
+				c.SetDownloadStopPolicy(policy)
+				c.SetUploadStopPolicy(policy)
+				if err := server.DownloadTest(); err != nil {
+					t.Error(err)
+				}
+				if err := server.UploadTest(); err != nil {
+					t.Error(err)
+				}
+				if server.DLSpeed <= 0 || server.ULSpeed <= 0 {
+					t.Errorf("run %d: got no rate %v, %v", i, server.DLSpeed, server.ULSpeed)
+				}
+				if i%3 == 2 {
+					c.Reset() // the handlers of the last test may still be reading
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// runClocked runs a download test of dm on the fake clock until it stops. Each
+// step adds the volume returned by feed, moves the clock a capture period
+// forward and waits for the sample. It returns the direction and the steps.
+func runClocked(t *testing.T, dm *DataManager, clock *fakeClock, feed func(step int) int64) (*TestDirection, int) {
+	t.Helper()
+	samples := make(chan struct{}, 1)
+	dm.SetCallbackDownload(func(ByteRate) {
+		select {
+		case samples <- struct{}{}:
+		default:
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	var once sync.Once
+	td := dm.RegisterDownloadHandler(func() {
+		once.Do(func() { close(started) }) // the capture and its timers are set up
+		<-ctx.Done()
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		td.Start(cancel, 0)
+	}()
+	<-started
+	step := 0
+	for td.isRunning() {
+		step++
+		td.AddTotalDataVolume(feed(step))
+		clock.Advance(dm.rateCaptureFrequency)
+		select {
+		case <-samples:
+		case <-done:
+		}
+	}
+	<-done
+	return td, step
+}
+
+func newClockedManager(clock *fakeClock) *DataManager {
+	dm := NewDataManager()
+	dm.SetClock(clock).SetRateCaptureFrequency(100 * time.Millisecond).SetCaptureTime(15 * time.Second).SetNThread(1)
+	return dm
+}
+
+func TestRateCaptureConverged(t *testing.T) {
+	clock := newFakeClock()
+	td, _ := runClocked(t, newClockedManager(clock), clock, func(int) int64 { return 1000 })
+	stats := td.Stats()
+	if stats.Quality.StopReason != StopConverged || !stats.Quality.Converged {
+		t.Errorf("got %v, converged %v, want a converged test", stats.Quality.StopReason, stats.Quality.Converged)
+	}
+	// the stability is evaluated after two windows of 5 seconds, the capture ends with the converged sample
+	if stats.Quality.Samples != 101 {
+		t.Errorf("got %d samples, want a convergence at the 101st", stats.Quality.Samples)
+	}
+	if rate := td.Rate(); rate < 9800 || rate > 10000 {
+		t.Errorf("got rate %.2f, want 10000 B/s", rate)
+	}
+}
+
+func TestRateCaptureTimeout(t *testing.T) {
+	clock := newFakeClock()
+	// a rate growing at each sample never converges
+	td, steps := runClocked(t, newClockedManager(clock), clock, func(step int) int64 { return int64(step) * 1000 })
+	stats := td.Stats()
+	if stats.Quality.StopReason != StopTimeout || stats.Quality.Converged {
+		t.Errorf("got %v, converged %v, want a timeout", stats.Quality.StopReason, stats.Quality.Converged)
+	}
+	td.mu.Lock()
+	elapsed := td.endTime.Sub(td.startTime)
+	td.mu.Unlock()
+	if steps != 150 || elapsed != 15*time.Second {
+		t.Errorf("got %d steps and %v, want 150 steps and 15s", steps, elapsed)
+	}
+}
+
+func TestRateCaptureVolumeNotReached(t *testing.T) {
+	clock := newFakeClock()
+	dm := newClockedManager(clock)
+	dm.SetRateCaptureFrequency(time.Second)
+	// the server stalls before the volume is reached
+	dm.SetDownloadStopPolicy(StopPolicy{Mode: StopVolume, Bytes: GB})
+	td, steps := runClocked(t, dm, clock, func(step int) int64 {
+		if step <= 10 {
+			return MB
+		}
+		return 0
+	})
+	if reason := td.Stats().Quality.StopReason; reason != StopTimeout {
+		t.Errorf("got %v, want %v", reason, StopTimeout)
+	}
+	if steps != int(MaxVolumeDuration/time.Second) {
+		t.Errorf("got %d steps, want the test to end after %v", steps, MaxVolumeDuration)
+	}
+}
+
+func TestRateCaptureWarmUpElapsed(t *testing.T) {
+	clock := newFakeClock()
+	dm := newClockedManager(clock)
+	dm.SetWarmUp(time.Second)
+	dm.SetDownloadStopPolicy(StopPolicy{Mode: StopDuration, Duration: 2 * time.Second})
+	td, steps := runClocked(t, dm, clock, func(step int) int64 {
+		if step <= 10 {
+			return 5000 // the slow start is left out of the rate
+		}
+		return 1000
+	})
+	stats := td.Stats()
+	if stats.WarmUp != time.Second || stats.Quality.StopReason != StopElapsed || steps != 30 {
+		t.Errorf("got warm-up %v, %v after %d steps, want 1s, %v after 30 steps", stats.WarmUp, stats.Quality.StopReason, steps, StopElapsed)
+	}
+	if rate := td.Rate(); rate != 10000 {
+		t.Errorf("got rate %.2f, want 10000 B/s", rate)
+	}
+}
@@ -5,11 +5,17 @@ import (
 	"os"
 )
 
+// Debug prints [DBG] lines to stdout.
+//
+// Deprecated: the clients log with a *slog.Logger, see WithLogger.
 type Debug struct {
 	dbg  *log.Logger
 	flag bool
 }
 
+// NewDebug returns a disabled Debug.
+//
+// Deprecated: use WithLogger.
 func NewDebug() *Debug {
 	return &Debug{dbg: log.New(os.Stdout, "[DBG]", log.Ldate|log.Ltime)}
 }
@@ -29,5 +35,3 @@ func (d *Debug) Printf(format string, v ...any) {
 		d.dbg.Printf(format, v...)
 	}
 }
-
-var dbg = NewDebug()
@@ -0,0 +1,80 @@
+package speedtest
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The default endpoints of the Ookla servers, resolved against the server URL.
+const (
+	DefaultDownloadURL = "random{size}x{size}.jpg"
+	DefaultUploadURL   = ""
+	DefaultLatencyURL  = "latency.txt"
+)
+
+// sizePlaceholder is replaced with the download size in the download URL template.
+const sizePlaceholder = "{size}"
+
+// endpoint resolves the URL template against the server URL. A relative
+// template is resolved next to the upload path of the server, an absolute
+// path against its host, and a full URL replaces it.
+func (s *Server) endpoint(template string, size int) (string, error) {
+	base, err := url.Parse(s.URL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(strings.ReplaceAll(template, sizePlaceholder, strconv.Itoa(size)))
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// downloadSize returns the configured download size, or the default one of the w level.
+func (s *Speedtest) downloadSize(w int) int {
+	if s.config != nil && s.config.DownloadSize > 0 {
+		return s.config.DownloadSize
+	}
+	return dlSizes[w]
+}
+
+// uploadSize returns the configured upload body size in bytes, or the default one of the w level.
+func (s *Speedtest) uploadSize(w int) int64 {
+	if s.config != nil && s.config.UploadSize > 0 {
+		return s.config.UploadSize
+	}
+	return int64(ulSizes[w]*100-51) * 10
+}
+
+func (s *Speedtest) downloadURL() string {
+	if s.config != nil && len(s.config.DownloadURL) > 0 {
+		return s.config.DownloadURL
+	}
+	return DefaultDownloadURL
+}
+
+func (s *Speedtest) uploadURL() string {
+	if s.config != nil && len(s.config.UploadURL) > 0 {
+		return s.config.UploadURL
+	}
+	return DefaultUploadURL
+}
+
+func (s *Speedtest) latencyURL() string {
+	if s.config != nil && len(s.config.LatencyURL) > 0 {
+		return s.config.LatencyURL
+	}
+	return DefaultLatencyURL
+}
+
+// customEndpoints reports whether a url template is configured.
+func (s *Speedtest) customEndpoints() bool {
+	return s.config != nil && (len(s.config.DownloadURL) > 0 || len(s.config.UploadURL) > 0 || len(s.config.LatencyURL) > 0)
+}
+
+// checkURLTemplate reports whether the template parses once the placeholder is filled.
+func checkURLTemplate(template string) error {
+	_, err := url.Parse(strings.ReplaceAll(template, sizePlaceholder, "0"))
+	return err
+}
@@ -0,0 +1,117 @@
+package speedtest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEndpoint(t *testing.T) {
+	s := &Server{URL: "http://example.com:8080/speedtest/upload.php"}
+	cases := []struct {
+		template string
+		size     int
+		expected string
+	}{
+		{DefaultDownloadURL, 1000, "http://example.com:8080/speedtest/random1000x1000.jpg"},
+		{DefaultUploadURL, 0, "http://example.com:8080/speedtest/upload.php"},
+		{DefaultLatencyURL, 0, "http://example.com:8080/speedtest/latency.txt"},
+		{"/__down?bytes={size}", 25000000, "http://example.com:8080/__down?bytes=25000000"},
+		{"https://other.example.com/ping", 0, "https://other.example.com/ping"},
+	}
+	for _, c := range cases {
+		u, err := s.endpoint(c.template, c.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u != c.expected {
+			t.Errorf("got %s for %q, expected %s", u, c.template, c.expected)
+		}
+	}
+}
+
+func TestCustomEndpoints(t *testing.T) {
+	var downloadBytes, uploadBytes, pings int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/down", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("bytes"))
+		atomic.StoreInt64(&downloadBytes, int64(n))
+		_, _ = w.Write(make([]byte, n))
+	})
+	mux.HandleFunc("/up", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		atomic.StoreInt64(&uploadBytes, n)
+	})
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&pings, 1)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	c := New(WithUserConfig(&UserConfig{
+		DownloadURL:  "/down?bytes={size}",
+		DownloadSize: 64 * 1024,
+		UploadURL:    "/up",
+		UploadSize:   32 * 1024,
+		LatencyURL:   "/ping",
+	}))
+	c.SetCaptureTime(time.Second)
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.TestAll(); err != nil {
+		t.Fatal(err)
+	}
+	if server.DLSpeed <= 0 || server.ULSpeed <= 0 {
+		t.Errorf("got unexpected speed, download: %v, upload: %v", server.DLSpeed, server.ULSpeed)
+	}
+	if atomic.LoadInt64(&downloadBytes) != 64*1024 || atomic.LoadInt64(&uploadBytes) != 32*1024 {
+		t.Errorf("got unexpected request sizes, download: %d, upload: %d", downloadBytes, uploadBytes)
+	}
+	if atomic.LoadInt64(&pings) == 0 {
+		t.Error("the latency url is not requested")
+	}
+}
+
+func TestCustomServerPath(t *testing.T) {
+	server, err := New().CustomServer("http://example.com:8080/api/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.URL != "http://example.com:8080/speedtest/upload.php" {
+		t.Errorf("got %s, want the path of the Ookla servers", server.URL)
+	}
+
+	// the templates are resolved against the given path
+	c := New(WithUserConfig(&UserConfig{DownloadURL: "down?bytes={size}", UploadURL: "up", LatencyURL: "ping"}))
+	server, err = c.CustomServer("http://example.com:8080/api/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := server.endpoint(c.downloadURL(), 1000); u != "http://example.com:8080/api/down?bytes=1000" {
+		t.Errorf("got %s, want the download url under the given path", u)
+	}
+}
+
+func TestUserConfigInvalidTemplate(t *testing.T) {
+	ts := newSpeedtestStandIn(1024)
+	defer ts.Close()
+
+	c := New()
+	if err := c.NewUserConfig(&UserConfig{DownloadURL: "/%zz?bytes={size}"}); err == nil {
+		t.Fatal("expected an error for an invalid url template")
+	}
+	// the client does not fall back to the default endpoints
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.PingTest(nil); err == nil {
+		t.Error("expected the ping to fail with the invalid config")
+	}
+}
@@ -0,0 +1,83 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// PhaseDiscovery is the phase of the errors fetching the user information
+// and the servers, it is not a test and Run does not accept it.
+const PhaseDiscovery Phase = "discovery"
+
+// Error is an error of a phase against a server, or of the discovery. The
+// cause is kept for errors.Is and errors.As, e.g.
+// errors.Is(err, ErrServerNotFound) or errors.Is(err, context.DeadlineExceeded).
+type Error struct {
+	Phase     Phase
+	Server    string // the server id, empty if the error is not bound to a server
+	Err       error
+	Temporary bool // a timeout or a dropped connection, retrying later may succeed
+}
+
+func (e *Error) Error() string {
+	if len(e.Server) == 0 {
+		return string(e.Phase) + ": " + e.Err.Error()
+	}
+	return string(e.Phase) + " of server " + e.Server + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// MarshalJSON encodes the error as an object with the phase, server, message and temporary fields.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Phase     Phase  `json:"phase"`
+		Server    string `json:"server,omitempty"`
+		Message   string `json:"message"`
+		Temporary bool   `json:"temporary"`
+	}{e.Phase, e.Server, e.Err.Error(), e.Temporary})
+}
+
+// wrapError returns err as an *Error of the phase and server, nil if err is nil.
+// An *Error in the chain of err is returned unchanged.
+func wrapError(phase Phase, server string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Phase: phase, Server: server, Err: err, Temporary: IsTemporary(err)}
+}
+
+// IsTemporary reports whether err is transient: a timeout, a refused or reset
+// connection, a transfer with too many failed requests or a temporary DNS failure.
+// The Temporary field decides for an *Error.
+func IsTemporary(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Temporary
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, ErrConnectTimeout),
+		errors.Is(err, ErrTransferFailed),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
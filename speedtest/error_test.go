@@ -0,0 +1,90 @@
+package speedtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsTemporary(t *testing.T) {
+	cases := []struct {
+		err       error
+		temporary bool
+	}{
+		{context.DeadlineExceeded, true},
+		{fmt.Errorf("dial: %w", syscall.ECONNREFUSED), true},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{ErrTransferFailed, true},
+		{context.Canceled, false},
+		{ErrServerNotFound, false},
+		{&Error{Phase: PhasePing, Err: context.DeadlineExceeded}, false}, // the field decides
+	}
+	for _, c := range cases {
+		if got := IsTemporary(c.err); got != c.temporary {
+			t.Errorf("IsTemporary(%v) = %v, expected %v", c.err, got, c.temporary)
+		}
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	if wrapError(PhasePing, "1", nil) != nil {
+		t.Error("a nil error is wrapped")
+	}
+	err := wrapError(PhaseDownload, "1", fmt.Errorf("request: %w", ErrConnectTimeout))
+	var e *Error
+	if !errors.As(err, &e) || e.Phase != PhaseDownload || e.Server != "1" || !e.Temporary {
+		t.Fatalf("got unexpected error %#v", err)
+	}
+	if !errors.Is(err, ErrConnectTimeout) {
+		t.Error("the cause is lost")
+	}
+	if err.Error() != "download of server 1: request: server connect timeout" {
+		t.Errorf("got unexpected message %q", err.Error())
+	}
+	if wrapError(PhaseUpload, "2", err) != err {
+		t.Error("an *Error is wrapped twice")
+	}
+
+	b, err := json.Marshal(wrapError(PhaseDiscovery, "", ErrServerNotFound))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"phase":"discovery","message":"no server available or found","temporary":false}` {
+		t.Errorf("got unexpected json %s", b)
+	}
+}
+
+func TestPhaseError(t *testing.T) {
+	ts := newSpeedtestStandIn(1024)
+	ts.Close() // nothing listens anymore
+
+	c := New()
+	c.SetCaptureTime(time.Second)
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.PingTest(nil)
+	var e *Error
+	if !errors.As(err, &e) || e.Phase != PhasePing || e.Server != "Custom" || !e.Temporary {
+		t.Errorf("got unexpected ping error %#v", err)
+	}
+	if err = server.DownloadTest(); !errors.Is(err, ErrTransferFailed) || !errors.As(err, &e) || e.Phase != PhaseDownload {
+		t.Errorf("got unexpected download error %v", err)
+	}
+	if err = server.UploadTest(); !errors.Is(err, ErrTransferFailed) || !errors.As(err, &e) || e.Phase != PhaseUpload {
+		t.Errorf("got unexpected upload error %v", err)
+	}
+	if err = server.MultiDownloadTestContext(context.Background(), Servers{server}); !errors.Is(err, ErrTransferFailed) {
+		t.Errorf("got unexpected multi download error %v", err)
+	}
+	if _, err = (Servers{}).FindServer(nil); !errors.Is(err, ErrServerNotFound) || !errors.As(err, &e) || e.Phase != PhaseDiscovery {
+		t.Errorf("got unexpected discovery error %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package speedtest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest/transport"
+)
+
+// Event is emitted to the observers of a client while the tests run, see
+// the event types below. Meta tells the server and phase it belongs to.
+type Event interface {
+	Meta() EventMeta
+}
+
+// EventMeta is the origin of an event.
+type EventMeta struct {
+	Server ServerInfo
+	Phase  Phase
+	Time   time.Time
+}
+
+func (m EventMeta) Meta() EventMeta {
+	return m
+}
+
+// PhaseStartEvent is emitted when a phase starts.
+type PhaseStartEvent struct {
+	EventMeta
+}
+
+// PhaseEndEvent is emitted when a phase ends, Err is nil if it succeeded.
+type PhaseEndEvent struct {
+	EventMeta
+	Err error
+}
+
+// PingEvent is emitted for each latency sample of the ping phase.
+type PingEvent struct {
+	EventMeta
+	Latency time.Duration
+}
+
+// ThroughputEvent is emitted at each rate capture of a download or upload test.
+type ThroughputEvent struct {
+	EventMeta
+	Bytes  int64    // payload bytes transferred since the start of the test
+	Delta  int64    // payload bytes transferred since the previous event
+	Rate   ByteRate // the EWMA, or the instantaneous rate during the warm-up
+	WarmUp bool     // the sample belongs to the warm-up
+}
+
+// ConnOpenEvent is emitted when a tcp connection to the server is opened.
+type ConnOpenEvent struct {
+	EventMeta
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+}
+
+// ConnCloseEvent is emitted when a tcp connection opened by a test is closed,
+// its meta is the one of the phase that opened it.
+type ConnCloseEvent struct {
+	EventMeta
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+}
+
+// RequestErrorEvent is emitted when a download, upload or ping request fails.
+type RequestErrorEvent struct {
+	EventMeta
+	Err error
+}
+
+// PacketLossEvent is emitted at each packet loss sample.
+type PacketLossEvent struct {
+	EventMeta
+	PacketLoss transport.PLoss
+}
+
+// Observer receives the events of a client. OnEvent is called synchronously
+// from the test goroutines, concurrently: it must be safe for concurrent use
+// and return quickly.
+type Observer interface {
+	OnEvent(e Event)
+}
+
+// ObserverFunc adapts a function to the Observer interface.
+type ObserverFunc func(e Event)
+
+func (f ObserverFunc) OnEvent(e Event) {
+	f(e)
+}
+
+// WithObserver subscribes the observer to the events of the client.
+func WithObserver(o Observer) Option {
+	return func(s *Speedtest) {
+		s.Subscribe(o)
+	}
+}
+
+// observers is the set of observers of a client.
+type observers struct {
+	mu   sync.RWMutex
+	list []*Observer
+}
+
+// Subscribe adds an observer to the client, the returned function removes it.
+func (s *Speedtest) Subscribe(o Observer) (unsubscribe func()) {
+	entry := &o
+	s.observers.mu.Lock()
+	s.observers.list = append(s.observers.list, entry)
+	s.observers.mu.Unlock()
+	return func() {
+		s.observers.mu.Lock()
+		defer s.observers.mu.Unlock()
+		for i, e := range s.observers.list {
+			if e == entry {
+				s.observers.list = append(s.observers.list[:i:i], s.observers.list[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Events returns a channel of the events of the client until the context is
+// done, the channel is closed then. The tests wait for the events to be
+// received once the buffer is full.
+func (s *Speedtest) Events(ctx context.Context, buffer int) <-chan Event {
+	ch := make(chan Event, buffer)
+	var mu sync.Mutex
+	closed := false
+	unsubscribe := s.Subscribe(ObserverFunc(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case ch <- e:
+		case <-ctx.Done():
+		}
+	}))
+	go func() {
+		<-ctx.Done()
+		unsubscribe()
+		mu.Lock()
+		closed = true
+		close(ch)
+		mu.Unlock()
+	}()
+	return ch
+}
+
+// observed reports whether the client has observers, to skip building unused events.
+func (s *Speedtest) observed() bool {
+	s.observers.mu.RLock()
+	defer s.observers.mu.RUnlock()
+	return len(s.observers.list) > 0
+}
+
+func (s *Speedtest) emit(e Event) {
+	s.observers.mu.RLock()
+	list := s.observers.list
+	s.observers.mu.RUnlock()
+	for _, o := range list {
+		(*o).OnEvent(e)
+	}
+}
+
+// eventMeta returns the meta of an event of the phase emitted now.
+func (s *Server) eventMeta(phase Phase) EventMeta {
+	return EventMeta{Server: s.Info(), Phase: phase, Time: time.Now()}
+}
+
+// startPhase emits the start of the phase, the returned function emits its end.
+func (s *Server) startPhase(phase Phase) func(err error) {
+	if s.Context.observed() {
+		s.Context.emit(PhaseStartEvent{s.eventMeta(phase)})
+	}
+	return func(err error) {
+		if s.Context.observed() {
+			s.Context.emit(PhaseEndEvent{EventMeta: s.eventMeta(phase), Err: err})
+		}
+	}
+}
+
+type eventMetaKey struct{}
+
+// withEventMeta tags the connections dialed with the context with the server
+// and phase, their bytes count into the server usage if it has its own counter.
+func (s *Server) withEventMeta(ctx context.Context, phase Phase) context.Context {
+	if s.wireBytes != nil {
+		ctx = context.WithValue(ctx, wireBytesKey{}, s.wireBytes)
+	}
+	return context.WithValue(ctx, eventMetaKey{}, EventMeta{Server: s.Info(), Phase: phase})
+}
+
+// observeConn emits the opening of the connection and wraps it to emit its closing.
+func (s *Speedtest) observeConn(ctx context.Context, conn net.Conn) net.Conn {
+	meta, ok := ctx.Value(eventMetaKey{}).(EventMeta)
+	if ok {
+		s.logger.Debug("connection opened", "server", meta.Server.ID, "phase", meta.Phase,
+			"local", conn.LocalAddr().String(), "remote", conn.RemoteAddr().String())
+	}
+	if !ok || !s.observed() {
+		return conn
+	}
+	meta.Time = time.Now()
+	s.emit(ConnOpenEvent{EventMeta: meta, LocalAddr: conn.LocalAddr(), RemoteAddr: conn.RemoteAddr()})
+	return &observedConn{Conn: conn, s: s, meta: meta}
+}
+
+type observedConn struct {
+	net.Conn
+	s    *Speedtest
+	meta EventMeta
+	once sync.Once
+}
+
+func (c *observedConn) Close() error {
+	c.once.Do(func() {
+		meta := c.meta
+		meta.Time = time.Now()
+		c.s.emit(ConnCloseEvent{EventMeta: meta, LocalAddr: c.LocalAddr(), RemoteAddr: c.RemoteAddr()})
+	})
+	return c.Conn.Close()
+}
+
+// observeTransfer hooks the throughput events of the phase to the direction
+// for the next test.
+func (s *Server) observeTransfer(td *TestDirection, phase Phase) {
+	td.onTick = nil
+	if !s.Context.observed() {
+		return
+	}
+	td.onTick = func(bytes, delta int64, rate ByteRate, warmUp bool) {
+		s.Context.emit(ThroughputEvent{EventMeta: s.eventMeta(phase), Bytes: bytes, Delta: delta, Rate: rate, WarmUp: warmUp})
+	}
+}
+
+// requestFailed emits the error of a request, unless the request was
+// canceled by the end of the test.
+func (s *Server) requestFailed(ctx context.Context, phase Phase, err error) {
+	if ctx.Err() != nil || !s.Context.observed() {
+		return
+	}
+	s.Context.emit(RequestErrorEvent{EventMeta: s.eventMeta(phase), Err: err})
+}
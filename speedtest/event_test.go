@@ -0,0 +1,114 @@
+package speedtest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) OnEvent(e Event) {
+	r.mu.Lock()
+	r.events = append(r.events, e)
+	r.mu.Unlock()
+}
+
+func (r *eventRecorder) count(match func(e Event) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, e := range r.events {
+		if match(e) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestObserver(t *testing.T) {
+	ts := newSpeedtestStandIn(256 * 1024)
+	defer ts.Close()
+
+	recorder := &eventRecorder{}
+	c := New(WithObserver(recorder))
+	c.SetCaptureTime(time.Second)
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.TestAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, phase := range []Phase{PhasePing, PhaseDownload, PhaseUpload} {
+		starts := recorder.count(func(e Event) bool { _, ok := e.(PhaseStartEvent); return ok && e.Meta().Phase == phase })
+		ends := recorder.count(func(e Event) bool {
+			end, ok := e.(PhaseEndEvent)
+			return ok && end.Phase == phase && end.Err == nil
+		})
+		if starts != 1 || ends != 1 {
+			t.Errorf("got %d starts and %d ends of %s", starts, ends, phase)
+		}
+	}
+	if n := recorder.count(func(e Event) bool { _, ok := e.(PingEvent); return ok }); n != 10 {
+		t.Errorf("got %d ping events, expected 10", n)
+	}
+	ticks := recorder.count(func(e Event) bool {
+		tick, ok := e.(ThroughputEvent)
+		return ok && tick.Phase == PhaseDownload && tick.Server.ID == "Custom" && tick.Bytes > 0
+	})
+	if ticks == 0 {
+		t.Error("got no download throughput event")
+	}
+	if n := recorder.count(func(e Event) bool { _, ok := e.(ConnOpenEvent); return ok }); n == 0 {
+		t.Error("got no connection event")
+	}
+	if n := recorder.count(func(e Event) bool { _, ok := e.(RequestErrorEvent); return ok }); n != 0 {
+		t.Errorf("got %d request errors", n)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ts := newSpeedtestStandIn(1024)
+	defer ts.Close()
+
+	c := New()
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events := c.Events(ctx, 0)
+	done := make(chan int)
+	go func() {
+		n := 0
+		for e := range events {
+			if _, ok := e.(PingEvent); ok {
+				n++
+			}
+		}
+		done <- n
+	}()
+	if err = server.PingTest(nil); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if n := <-done; n != 10 {
+		t.Errorf("got %d ping events, expected 10", n)
+	}
+
+	recorder := &eventRecorder{}
+	unsubscribe := c.Subscribe(recorder)
+	unsubscribe()
+	if err = server.PingTest(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.events) != 0 {
+		t.Errorf("got %d events after unsubscribing", len(recorder.events))
+	}
+}
@@ -0,0 +1,162 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// quicDialer dials the QUIC connections of the HTTP/3 transport from a single
+// UDP socket, bound to the source address and interface of the client.
+type quicDialer struct {
+	localAddr *net.UDPAddr
+	control   func(network, address string, c syscall.RawConn) error
+	resolver  *net.Resolver
+	times     *ResolveTimes
+	count     func(n int64)      // the bytes of the datagrams, not counted if nil
+	budget    func() *DataBudget // limits the datagrams once counted
+
+	mu        sync.Mutex
+	transport *quic.Transport
+}
+
+func (d *quicDialer) quicTransport(ctx context.Context) (*quic.Transport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.transport != nil {
+		return d.transport, nil
+	}
+	var local string
+	if d.localAddr != nil {
+		local = d.localAddr.String()
+	}
+	lc := net.ListenConfig{Control: d.control}
+	conn, err := lc.ListenPacket(ctx, "udp", local)
+	if err != nil {
+		return nil, err
+	}
+	if d.count != nil {
+		counting := &countingPacketConn{PacketConn: conn, add: d.count}
+		if d.budget != nil {
+			counting.budget = d.budget()
+		}
+		conn = counting
+	}
+	d.transport = &quic.Transport{Conn: conn}
+	return d.transport, nil
+}
+
+// Dial resolves the host with the client resolver and dials the resolved
+// addresses in order. QUIC runs the TLS handshake as part of the connection
+// establishment, both are reported to the connection tracer.
+func (d *quicDialer) Dial(ctx context.Context, address string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IPAddr{{IP: ip}}
+	} else {
+		resolver := d.resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		start := time.Now()
+		ips, err = resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		d.times.record(host, time.Since(start))
+	}
+	tr, err := d.quicTransport(ctx)
+	if err != nil {
+		return nil, err
+	}
+	trace := httptrace.ContextClientTrace(ctx)
+	var conn *quic.Conn
+	for _, ip := range ips {
+		addr := &net.UDPAddr{IP: ip.IP, Port: portNum, Zone: ip.Zone}
+		if trace != nil && trace.ConnectStart != nil {
+			trace.ConnectStart("udp", addr.String())
+		}
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		conn, err = tr.DialEarly(ctx, addr, tlsConfig, config)
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			var state tls.ConnectionState
+			if conn != nil {
+				state = conn.ConnectionState().TLS
+			}
+			trace.TLSHandshakeDone(state, err)
+		}
+		if trace != nil && trace.ConnectDone != nil {
+			trace.ConnectDone("udp", addr.String(), err)
+		}
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Close closes the UDP socket and every connection dialed from it.
+func (d *quicDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.transport == nil {
+		return nil
+	}
+	err := d.transport.Close()
+	d.transport = nil
+	return err
+}
+
+// http3RoundTripper carries the test requests over HTTP/3.
+type http3RoundTripper struct {
+	s        *Speedtest
+	t        *http3.Transport
+	upgraded sync.Map // hosts of the http urls requested over https
+}
+
+func (rt *http3RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// QUIC always runs over TLS, the plain http urls of the server list are upgraded.
+	if req.URL.Scheme == "http" {
+		if _, loaded := rt.upgraded.LoadOrStore(req.URL.Host, true); !loaded {
+			rt.s.logger.Warn("http3 requests the http url over https", "host", req.URL.Host)
+		}
+		req = req.Clone(req.Context())
+		req.URL.Scheme = "https"
+	}
+	req.Header.Set("User-Agent", rt.s.config.UserAgent)
+	return rt.t.RoundTrip(req)
+}
+
+// markHTTP3Bypass records that the http requests of a test reach the server
+// over QUIC, without the proxy.
+func (s *Server) markHTTP3Bypass() {
+	if s.Context.h3 != nil && s.Context.proxyDialer != nil {
+		s.MarkProxyBypass(BypassHTTP3)
+	}
+}
+
+// testDoer returns the client of the download, upload and http ping requests.
+func (s *Speedtest) testDoer() *http.Client {
+	if s.h3 != nil {
+		return s.h3
+	}
+	return s.doer
+}
@@ -0,0 +1,84 @@
+package speedtest
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3(t *testing.T) {
+	// borrow the certificate of an httptest server, it covers 127.0.0.1
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	var requests, nonH3 atomic.Int64
+	standIn := speedtestStandIn(64 * 1024)
+	h3Server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(ts.TLS),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			if r.ProtoMajor != 3 {
+				nonH3.Add(1)
+			}
+			standIn.ServeHTTP(w, r)
+		}),
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = h3Server.Serve(conn) }()
+	defer h3Server.Close()
+
+	// QUIC is not tunnelled through the proxy, the tests reach the server directly
+	c := New(WithDoer(&http.Client{}), WithUserConfig(&UserConfig{HTTP3: true, Proxy: "socks5://127.0.0.1:1"}))
+	c.h3.Transport.(*http3RoundTripper).t.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+	c.SetCaptureTime(time.Second)
+
+	// the plain http url is upgraded, QUIC always runs over TLS
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	server, err := c.CustomServer("http://127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.PingTest(nil); err != nil {
+		t.Fatal(err)
+	}
+	if server.Latency <= 0 {
+		t.Errorf("got unexpected latency %v", server.Latency)
+	}
+	if err = server.DownloadTest(); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.UploadTest(); err != nil {
+		t.Fatal(err)
+	}
+	if server.DLSpeed <= 0 || server.ULSpeed <= 0 {
+		t.Errorf("got unexpected speed, download: %v, upload: %v", server.DLSpeed, server.ULSpeed)
+	}
+	if requests.Load() == 0 || nonH3.Load() != 0 {
+		t.Errorf("got %d requests, %d of them not over HTTP/3", requests.Load(), nonH3.Load())
+	}
+	if timing := server.Timing.Ping; timing == nil || timing.TLSHandshake <= 0 {
+		t.Errorf("got incomplete ping timing %+v", timing)
+	}
+	if server.TLS == nil || server.TLS.Version != "TLS 1.3" {
+		t.Errorf("got unexpected tls info %+v", server.TLS)
+	}
+	// the datagrams of the QUIC socket count into the usage
+	for _, phase := range []Phase{PhasePing, PhaseDownload, PhaseUpload} {
+		if server.DataUsage[phase] <= 0 {
+			t.Errorf("the %s usage is not recorded", phase)
+		}
+	}
+	if !slices.Equal(server.ProxyBypass, []string{BypassHTTP3}) {
+		t.Errorf("got proxy bypass %v, want %v", server.ProxyBypass, []string{BypassHTTP3})
+	}
+}
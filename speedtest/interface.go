@@ -0,0 +1,123 @@
+package speedtest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var (
+	ErrInterfaceNoAddress = errors.New("no usable address on interface")
+)
+
+// interfaceAddr returns the first usable unicast address of the named
+// network interface, IPv4 preferred.
+func interfaceAddr(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var fallback net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsMulticast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if fallback == nil {
+			fallback = ipNet.IP
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("%w: %s", ErrInterfaceNoAddress, name)
+	}
+	return fallback, nil
+}
+
+// chainControl runs every non-nil control function in order on the raw socket.
+func chainControl(controls ...func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	var fns []func(network, address string, c syscall.RawConn) error
+	for _, fn := range controls {
+		if fn != nil {
+			fns = append(fns, fn)
+		}
+	}
+	if len(fns) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, fn := range fns {
+			if err := fn(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// refuseControl fails every socket with err, so a client whose interface
+// cannot be bound never falls back to the default route.
+func refuseControl(err error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return err
+	}
+}
+
+// interfaceBinding describes how the sockets of a client are tied to an interface.
+// On Linux the sockets are bound with SO_BINDTODEVICE, elsewhere the
+// interface address is used as the source address of each socket.
+type interfaceBinding struct {
+	control func(network, address string, c syscall.RawConn) error
+	ip      net.IP
+}
+
+func newInterfaceBinding(name string) (*interfaceBinding, error) {
+	ip, err := interfaceAddr(name)
+	// an interface without address can still be bound by device,
+	// e.g. a DHCP uplink that is renewing its lease.
+	if err != nil && (!bindToDeviceSupported || !errors.Is(err, ErrInterfaceNoAddress)) {
+		return nil, err
+	}
+	return &interfaceBinding{control: bindToDeviceControl(name), ip: ip}, nil
+}
+
+// tcpAddr returns the source address to use when device binding is unavailable.
+func (b *interfaceBinding) tcpAddr() net.Addr {
+	if b.control != nil || b.ip == nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: b.ip}
+}
+
+func (b *interfaceBinding) ipAddr() net.Addr {
+	if b.control != nil || b.ip == nil {
+		return nil
+	}
+	return &net.IPAddr{IP: b.ip}
+}
+
+func (b *interfaceBinding) udpAddr() net.Addr {
+	if b.control != nil || b.ip == nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: b.ip}
+}
+
+// localAddr returns the source address matching the given network.
+func (b *interfaceBinding) localAddr(network string) net.Addr {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return b.udpAddr()
+	case "tcp", "tcp4", "tcp6":
+		return b.tcpAddr()
+	default:
+		return b.ipAddr()
+	}
+}
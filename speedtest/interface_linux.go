@@ -0,0 +1,22 @@
+package speedtest
+
+import (
+	"syscall"
+)
+
+const bindToDeviceSupported = true
+
+// bindToDeviceControl binds the socket to the named device with SO_BINDTODEVICE,
+// so the traffic leaves through that interface regardless of the routing table.
+func bindToDeviceControl(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			opErr = syscall.BindToDevice(int(fd), name)
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
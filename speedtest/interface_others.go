@@ -0,0 +1,15 @@
+//go:build !linux
+
+package speedtest
+
+import (
+	"syscall"
+)
+
+const bindToDeviceSupported = false
+
+// bindToDeviceControl is only available on Linux, the interface address
+// is used as the source address instead.
+func bindToDeviceControl(_ string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
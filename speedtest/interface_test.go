@@ -0,0 +1,83 @@
+package speedtest
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+
+	"github.com/showwin/speedtest-go/speedtest/transport"
+)
+
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestInterfaceAddr(t *testing.T) {
+	name := loopbackInterface(t)
+	ip, err := interfaceAddr(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.IsLoopback() {
+		t.Errorf("got unexpected address %v on interface %s", ip, name)
+	}
+
+	if _, err = interfaceAddr("speedtest-go-none"); err == nil {
+		t.Error("expected error for unknown interface")
+	}
+}
+
+func TestUserConfigInterface(t *testing.T) {
+	name := loopbackInterface(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	c := New(WithUserConfig(&UserConfig{Interface: name}))
+	if bindToDeviceSupported && c.tcpDialer.Control == nil {
+		t.Fatal("dialer is not bound to the interface")
+	}
+	if !bindToDeviceSupported && c.tcpDialer.LocalAddr == nil {
+		t.Fatal("dialer has no interface source address")
+	}
+	resp, err := c.doer.Get(ts.URL)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("binding to device not permitted")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestUserConfigUnknownInterface(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	c := New()
+	if err := c.NewUserConfig(&UserConfig{Interface: "speedtest-go-none"}); err == nil {
+		t.Fatal("expected error for unknown interface")
+	}
+	// the default route is never used in place of the interface
+	if resp, err := c.doer.Get(ts.URL); err == nil {
+		_ = resp.Body.Close()
+		t.Error("the client dialed without the interface")
+	}
+
+	analyzer := NewPacketLossAnalyzer(&PacketLossAnalyzerOptions{Interface: "speedtest-go-none"})
+	if err := analyzer.Run("127.0.0.1:1", func(*transport.PLoss) {}); err == nil || errors.Is(err, transport.ErrUnsupported) {
+		t.Errorf("got %v, want the interface error", err)
+	}
+}
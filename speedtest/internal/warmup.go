@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"time"
+)
+
+const (
+	warmUpWindow    = 500 * time.Millisecond // the rate is averaged over a window before comparing
+	warmUpGrowth    = 0.1                    // a window growing less than 10% over the previous one is flat
+	warmUpFlatTimes = 2                      // consecutive flat windows that end the warm-up
+)
+
+// WarmUp detects the end of the TCP slow start phase of a transfer,
+// either after a fixed duration or once the rate growth flattens.
+type WarmUp struct {
+	duration time.Duration // fixed warm-up, zero to detect the flattening
+	max      time.Duration // upper bound of the detection
+	window   int           // samples per window
+	n        int
+	sum      float64
+	prev     float64
+	flat     int
+}
+
+// NewWarmUp returns a warm-up of the given duration, or detecting the end of
+// the slow start with at most max if duration is zero.
+func NewWarmUp(duration, max, frequency time.Duration) *WarmUp {
+	window := int(warmUpWindow / frequency)
+	if window < 1 {
+		window = 1
+	}
+	return &WarmUp{duration: duration, max: max, window: window}
+}
+
+// Update enters the volume transferred during the last sample.
+// return bool the warm-up is over
+func (w *WarmUp) Update(value float64, elapsed time.Duration) bool {
+	if w.duration > 0 {
+		return elapsed >= w.duration
+	}
+	if elapsed >= w.max {
+		return true
+	}
+	w.sum += value
+	w.n++
+	if w.n < w.window {
+		return false
+	}
+	avg := w.sum / float64(w.n)
+	w.sum, w.n = 0, 0
+	if w.prev > 0 && avg <= w.prev*(1+warmUpGrowth) {
+		w.flat++
+	} else {
+		w.flat = 0
+	}
+	if avg > 0 {
+		w.prev = avg
+	}
+	return w.flat >= warmUpFlatTimes
+}
@@ -35,3 +35,31 @@ func TestWOM(t *testing.T) {
 		t.Fatal("TestWOM failed")
 	}
 }
+
+func TestWarmUp(t *testing.T) {
+	frequency := 50 * time.Millisecond
+	w := NewWarmUp(0, 5*time.Second, frequency)
+	// slow start doubles the rate each 100ms up to 64, then stays flat
+	var elapsed time.Duration
+	end := time.Duration(0)
+	for i := 0; i < 100; i++ {
+		elapsed += frequency
+		value := float64(int(1) << min(i/2, 6))
+		if w.Update(value, elapsed) {
+			end = elapsed
+			break
+		}
+	}
+	if end < 700*time.Millisecond || end > 3*time.Second {
+		t.Errorf("got unexpected warm-up end %v", end)
+	}
+
+	fixed := NewWarmUp(time.Second, 5*time.Second, frequency)
+	if fixed.Update(1, 950*time.Millisecond) || !fixed.Update(1, time.Second) {
+		t.Error("the fixed warm-up does not end after its duration")
+	}
+	capped := NewWarmUp(0, time.Second, frequency)
+	if !capped.Update(1, time.Second) {
+		t.Error("the detection is not capped")
+	}
+}
@@ -0,0 +1,62 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInterruptedTransfer(t *testing.T) {
+	ts := newSpeedtestStandIn(256 * 1024)
+	defer ts.Close()
+
+	c := New()
+	c.SetCaptureTime(10 * time.Second)
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = server.DownloadTestContext(ctx)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("the download ran %v after the context was done", elapsed)
+	}
+	var e *Error
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &e) || e.Phase != PhaseDownload {
+		t.Errorf("got unexpected error %v", err)
+	}
+	if !server.Partial || server.DLSpeed <= 0 || server.DLStats.Quality.StopReason != StopCanceled {
+		t.Errorf("got no partial download: %v, %v, %s", server.Partial, server.DLSpeed, server.DLStats.Quality.StopReason)
+	}
+
+	// a test started with a done context ends at once
+	err = server.UploadTestContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || server.ULStats.Quality.StopReason != StopCanceled {
+		t.Errorf("got unexpected upload %v, %s", err, server.ULStats.Quality.StopReason)
+	}
+}
+
+func TestInterruptedPing(t *testing.T) {
+	ts := newSpeedtestStandIn(1024)
+	defer ts.Close()
+
+	server, err := New().CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+	defer cancel()
+	err = server.PingTestContext(ctx, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got unexpected error %v", err)
+	}
+	if !server.Partial || server.Latency <= 0 {
+		t.Errorf("the completed echoes are lost: %v, %v", server.Partial, server.Latency)
+	}
+	if result := server.Result(); !result.Partial {
+		t.Error("the result is not partial")
+	}
+}
@@ -3,8 +3,10 @@ package speedtest
 import (
 	"errors"
 	"fmt"
+	"maps"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type Location struct {
@@ -45,9 +47,13 @@ var Locations = map[string]*Location{
 }
 
 func PrintCityList() {
+	printCityList(Locations)
+}
+
+func printCityList(locations map[string]*Location) {
 	fmt.Println("Available city labels (case insensitive): ")
 	fmt.Println(" CC\t\tCityLabel\tLocation")
-	for k, v := range Locations {
+	for k, v := range locations {
 		fmt.Printf("(%v)\t%20s\t[%v, %v]\n", v.CC, k, v.Lat, v.Lon)
 	}
 }
@@ -61,35 +67,103 @@ func GetLocation(locationName string) (*Location, error) {
 }
 
 // NewLocation new a Location
+//
+// Deprecated: the location is added to the Locations shared by the whole
+// process, use Speedtest.NewLocation instead.
 func NewLocation(locationName string, latitude float64, longitude float64) *Location {
-	var loc Location
-	loc.Lat = latitude
-	loc.Lon = longitude
-	loc.Name = locationName
-	Locations[locationName] = &loc
-	return &loc
+	loc := &Location{Name: locationName, Lat: latitude, Lon: longitude}
+	Locations[strings.ToLower(locationName)] = loc
+	return loc
 }
 
 // ParseLocation parse latitude and longitude string
+//
+// Deprecated: the location is added to the Locations shared by the whole
+// process, use Speedtest.ParseLocation instead.
 func ParseLocation(locationName string, coordinateStr string) (*Location, error) {
+	name, lat, lon, err := parseCoordinates(locationName, coordinateStr)
+	if err != nil {
+		return nil, err
+	}
+	return NewLocation(name, lat, lon), nil
+}
+
+func parseCoordinates(locationName string, coordinateStr string) (string, float64, float64, error) {
 	ll := strings.Split(coordinateStr, ",")
 	if len(ll) == 2 {
 		// parameters check
 		lat, err := betweenRange(ll[0], 90)
 		if err != nil {
-			return nil, err
+			return "", 0, 0, err
 		}
 		lon, err := betweenRange(ll[1], 180)
 		if err != nil {
-			return nil, err
+			return "", 0, 0, err
 		}
 		name := "Custom-%s"
 		if len(locationName) == 0 {
 			name = "Custom-Default"
 		}
-		return NewLocation(fmt.Sprintf(name, locationName), lat, lon), nil
+		return fmt.Sprintf(name, locationName), lat, lon, nil
+	}
+	return "", 0, 0, fmt.Errorf("invalid location input: %s", coordinateStr)
+}
+
+// locationTable is the city table of a client, seeded with a copy of Locations.
+type locationTable struct {
+	mu sync.RWMutex
+	m  map[string]*Location
+}
+
+func newLocationTable() *locationTable {
+	t := &locationTable{m: make(map[string]*Location, len(Locations))}
+	for k, v := range Locations {
+		loc := *v
+		t.m[k] = &loc
+	}
+	return t
+}
+
+// Locations returns a copy of the city table of the client.
+func (s *Speedtest) Locations() map[string]*Location {
+	s.locations.mu.RLock()
+	defer s.locations.mu.RUnlock()
+	return maps.Clone(s.locations.m)
+}
+
+// PrintCityList prints the city table of the client.
+func (s *Speedtest) PrintCityList() {
+	printCityList(s.Locations())
+}
+
+// GetLocation returns the location of a city label of the client, case insensitive.
+func (s *Speedtest) GetLocation(locationName string) (*Location, error) {
+	s.locations.mu.RLock()
+	defer s.locations.mu.RUnlock()
+	loc, ok := s.locations.m[strings.ToLower(locationName)]
+	if ok {
+		return loc, nil
+	}
+	return nil, errors.New("not found location")
+}
+
+// NewLocation adds a location to the city table of the client, GetLocation
+// finds it by its name in any case.
+func (s *Speedtest) NewLocation(locationName string, latitude float64, longitude float64) *Location {
+	loc := &Location{Name: locationName, Lat: latitude, Lon: longitude}
+	s.locations.mu.Lock()
+	s.locations.m[strings.ToLower(locationName)] = loc
+	s.locations.mu.Unlock()
+	return loc
+}
+
+// ParseLocation parses a "lat,lon" coordinate and adds it to the city table of the client.
+func (s *Speedtest) ParseLocation(locationName string, coordinateStr string) (*Location, error) {
+	name, lat, lon, err := parseCoordinates(locationName, coordinateStr)
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("invalid location input: %s", coordinateStr)
+	return s.NewLocation(name, lat, lon), nil
 }
 
 func (l *Location) String() string {
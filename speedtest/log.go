@@ -0,0 +1,33 @@
+package speedtest
+
+import "log/slog"
+
+// discardLogger is the logger of a client created without WithLogger or UserConfig.Debug.
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// WithLogger sets the structured logger of the client. The records carry
+// the server id, phase and connection addresses as attributes, and a nil
+// logger discards them. It takes precedence over UserConfig.Debug, which
+// otherwise logs at debug level to stderr.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Speedtest) {
+		if logger == nil {
+			logger = discardLogger
+		}
+		s.loggerSet = true
+		s.setLogger(logger)
+	}
+}
+
+// Logger returns the structured logger of the client.
+func (s *Speedtest) Logger() *slog.Logger {
+	return s.logger
+}
+
+// setLogger sets the logger of the client and of its data manager.
+func (s *Speedtest) setLogger(logger *slog.Logger) {
+	s.logger = logger
+	if dm, ok := s.Manager.(*DataManager); ok {
+		dm.logger = logger // the transfers log with the client
+	}
+}
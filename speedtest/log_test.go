@@ -0,0 +1,80 @@
+package speedtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is written by the transfer goroutines while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
+
+func TestWithLogger(t *testing.T) {
+	ts := newSpeedtestStandIn(64 * 1024)
+	defer ts.Close()
+
+	var buf syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c := New(WithLogger(logger), WithUserConfig(&UserConfig{Debug: true, Proxy: "%zz"}))
+	if c.Logger() != logger || c.Manager.(*DataManager).logger != logger {
+		t.Fatal("UserConfig.Debug replaced the logger")
+	}
+	c.SetCaptureTime(time.Second)
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.DownloadTest(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := map[string][]map[string]any{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var record map[string]any
+		if err = json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("invalid json record %q: %v", line, err)
+		}
+		msg := record[slog.MessageKey].(string)
+		records[msg] = append(records[msg], record)
+	}
+	if warns := records["skipping parse the proxy host"]; len(warns) != 1 || warns[0][slog.LevelKey] != "WARN" || warns[0]["err"] == nil {
+		t.Errorf("got unexpected proxy warnings %v", warns)
+	}
+	conns := records["connection opened"]
+	if len(conns) == 0 {
+		t.Fatal("got no connection record")
+	}
+	for _, conn := range conns {
+		if conn["server"] != "Custom" || conn["phase"] != string(PhaseDownload) || conn["remote"] == "" {
+			t.Errorf("got unexpected connection record %v", conn)
+		}
+	}
+	if len(records["download request"]) == 0 {
+		t.Error("got no download request record")
+	}
+}
+
+func TestWithLoggerNil(t *testing.T) {
+	c := New(WithLogger(nil), WithUserConfig(&UserConfig{Debug: true}))
+	if c.Logger() != discardLogger {
+		t.Error("a nil logger does not discard the records")
+	}
+}
@@ -2,9 +2,12 @@ package speedtest
 
 import (
 	"context"
+	"fmt"
 	"github.com/showwin/speedtest-go/speedtest/transport"
 	"net"
+	"net/url"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -13,14 +16,20 @@ type PacketLossAnalyzerOptions struct {
 	SamplingDuration       time.Duration
 	PacketSendingInterval  time.Duration
 	PacketSendingTimeout   time.Duration
-	SourceInterface        string      // source interface
+	SourceInterface        string      // source address
+	Interface              string      // bind both sampling and sending sockets to the named network interface
+	Proxy                  string      // tunnel sampling through the proxy, and packets if it is a socks5 proxy
 	TCPDialer              *net.Dialer // tcp dialer for sampling
 	UDPDialer              *net.Dialer // udp dialer for sending packet
-
+	Budget                 *DataBudget // count the bytes into the packet loss phase, stop sending once it is spent
 }
 
 type PacketLossAnalyzer struct {
-	options *PacketLossAnalyzerOptions
+	options       *PacketLossAnalyzerOptions
+	tcpDialer     transport.Dialer
+	udpDialer     transport.Dialer
+	proxyBypassed bool
+	bindErr       error // of the interface, the analyzer does not run without it
 }
 
 func NewPacketLossAnalyzer(options *PacketLossAnalyzerOptions) *PacketLossAnalyzer {
@@ -39,25 +48,76 @@ func NewPacketLossAnalyzer(options *PacketLossAnalyzerOptions) *PacketLossAnalyz
 	if options.PacketSendingTimeout == 0 {
 		options.PacketSendingTimeout = 5 * time.Second
 	}
+	var tcpAddr, udpAddr net.Addr
+	var control func(network, address string, c syscall.RawConn) error
+	if len(options.SourceInterface) > 0 {
+		// skip error and using auto-select
+		_, address := parseAddr(options.SourceInterface)
+		if ip := net.ParseIP(address); ip != nil {
+			tcpAddr = &net.TCPAddr{IP: ip}
+			udpAddr = &net.UDPAddr{IP: ip}
+		}
+	}
+	var bindErr error
+	if len(options.Interface) > 0 {
+		// the packets never fall back to the default route
+		if binding, err := newInterfaceBinding(options.Interface); err != nil {
+			bindErr = fmt.Errorf("interface %s: %w", options.Interface, err)
+			control = refuseControl(bindErr)
+		} else {
+			control = binding.control
+			if addr := binding.tcpAddr(); addr != nil {
+				tcpAddr = addr
+			}
+			if addr := binding.udpAddr(); addr != nil {
+				udpAddr = addr
+			}
+		}
+	}
 	if options.TCPDialer == nil {
 		options.TCPDialer = &net.Dialer{
-			Timeout: options.PacketSendingTimeout,
+			Timeout:   options.PacketSendingTimeout,
+			LocalAddr: tcpAddr,
+			Control:   control,
 		}
 	}
 	if options.UDPDialer == nil {
-		var addr net.Addr
-		if len(options.SourceInterface) > 0 {
-			// skip error and using auto-select
-			addr, _ = net.ResolveUDPAddr("udp", options.SourceInterface)
-		}
 		options.UDPDialer = &net.Dialer{
 			Timeout:   options.PacketSendingTimeout,
-			LocalAddr: addr,
+			LocalAddr: udpAddr,
+			Control:   control,
 		}
 	}
-	return &PacketLossAnalyzer{
-		options: options,
+	pla := &PacketLossAnalyzer{
+		options:   options,
+		tcpDialer: options.TCPDialer,
+		udpDialer: options.UDPDialer,
+		bindErr:   bindErr,
 	}
+	if len(options.Proxy) > 0 {
+		// skip error and send directly
+		pla.proxyBypassed = true
+		if proxyURL, err := url.Parse(options.Proxy); err == nil {
+			if proxyDialer, err := transport.NewProxyDialer(proxyURL, options.TCPDialer, options.UDPDialer); err == nil {
+				pla.tcpDialer = proxyDialer
+				if proxyDialer.SupportsUDP() {
+					pla.udpDialer = proxyDialer
+					pla.proxyBypassed = false
+				}
+			}
+		}
+	}
+	if options.Budget != nil {
+		pla.tcpDialer = &countingDialer{Dialer: pla.tcpDialer, budget: options.Budget, phase: PhasePacketLoss}
+		pla.udpDialer = &countingDialer{Dialer: pla.udpDialer, budget: options.Budget, phase: PhasePacketLoss}
+	}
+	return pla
+}
+
+// ProxyBypassed reports whether the packets are sent without the configured proxy,
+// only socks5 proxies are able to relay udp packets.
+func (pla *PacketLossAnalyzer) ProxyBypassed() bool {
+	return pla.proxyBypassed
 }
 
 // RunMulti Mix all servers to get the average packet loss.
@@ -68,6 +128,9 @@ func (pla *PacketLossAnalyzer) RunMulti(hosts []string) (*transport.PLoss, error
 }
 
 func (pla *PacketLossAnalyzer) RunMultiWithContext(ctx context.Context, hosts []string) (*transport.PLoss, error) {
+	if pla.bindErr != nil {
+		return nil, pla.bindErr
+	}
 	results := make(map[string]*transport.PLoss)
 	mutex := &sync.Mutex{}
 	wg := &sync.WaitGroup{}
@@ -104,11 +167,14 @@ func (pla *PacketLossAnalyzer) Run(host string, callback func(packetLoss *transp
 }
 
 func (pla *PacketLossAnalyzer) RunWithContext(ctx context.Context, host string, callback func(packetLoss *transport.PLoss)) error {
-	samplerClient, err := transport.NewClient(pla.options.TCPDialer)
+	if pla.bindErr != nil {
+		return pla.bindErr
+	}
+	samplerClient, err := transport.NewClient(pla.tcpDialer)
 	if err != nil {
 		return transport.ErrUnsupported
 	}
-	senderClient, err := transport.NewPacketLossSender(samplerClient.ID(), pla.options.UDPDialer)
+	senderClient, err := transport.NewPacketLossSender(samplerClient.ID(), pla.udpDialer)
 	if err != nil {
 		return transport.ErrUnsupported
 	}
@@ -152,6 +218,9 @@ func (pla *PacketLossAnalyzer) loopSender(ctx context.Context, senderClient *tra
 	for {
 		select {
 		case <-sendTick.C:
+			if pla.options.Budget != nil && pla.options.Budget.Remaining(PhasePacketLoss) == 0 {
+				return
+			}
 			_ = senderClient.Send(order)
 			order++
 		case <-ctx.Done():
@@ -159,3 +228,62 @@ func (pla *PacketLossAnalyzer) loopSender(ctx context.Context, senderClient *tra
 		}
 	}
 }
+
+// SetPacketLossOptions sets the options of the analyzers of the client, see
+// NewPacketLossAnalyzer.
+func (s *Speedtest) SetPacketLossOptions(options PacketLossAnalyzerOptions) {
+	s.lossOptions = options
+}
+
+// NewPacketLossAnalyzer returns an analyzer with the options of the client,
+// the source address, interface, proxy and data budget default to the ones
+// of the client.
+func (s *Speedtest) NewPacketLossAnalyzer() *PacketLossAnalyzer {
+	options := s.lossOptions
+	if len(options.SourceInterface) == 0 {
+		options.SourceInterface = s.config.Source
+	}
+	if len(options.Interface) == 0 {
+		options.Interface = s.config.Interface
+	}
+	if len(options.Proxy) == 0 {
+		options.Proxy = s.config.Proxy
+	}
+	if options.Budget == nil {
+		options.Budget = s.GetDataBudget()
+	}
+	return NewPacketLossAnalyzer(&options)
+}
+
+// packetLossTest runs an analyzer of the client against the server for its
+// sampling duration.
+func (s *Server) packetLossTest(ctx context.Context) error {
+	analyzer := s.Context.NewPacketLossAnalyzer()
+	if analyzer.ProxyBypassed() {
+		s.MarkProxyBypass(BypassPacketLoss)
+	}
+	lossCtx, cancel := context.WithTimeout(ctx, analyzer.options.SamplingDuration)
+	defer cancel()
+	if err := s.PacketLossTestContext(lossCtx, analyzer); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		s.Partial = true
+		return wrapError(PhasePacketLoss, s.ID, ctx.Err())
+	}
+	return nil
+}
+
+// PacketLossTestContext runs the analyzer against the server until the
+// context is done, the last sample is kept in PacketLoss.
+func (s *Server) PacketLossTestContext(ctx context.Context, analyzer *PacketLossAnalyzer) (err error) {
+	end := s.startPhase(PhasePacketLoss)
+	defer func() { end(err) }()
+	defer func() { err = wrapError(PhasePacketLoss, s.ID, err) }()
+	return analyzer.RunWithContext(ctx, s.Host, func(packetLoss *transport.PLoss) {
+		s.PacketLoss = *packetLoss
+		if s.Context.observed() {
+			s.Context.emit(PacketLossEvent{EventMeta: s.eventMeta(PhasePacketLoss), PacketLoss: *packetLoss})
+		}
+	})
+}
@@ -0,0 +1,262 @@
+package netem
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// segment is a part of the stream on its way over the link.
+type segment struct {
+	data []byte
+	at   time.Time // arrival at the other end
+	err  error     // of the connection, after the data
+}
+
+// conn carries a connection over a link. The bytes written are paced by the
+// uplink and delivered to the connection once delayed, the bytes read are
+// paced by the downlink and returned once delayed.
+type conn struct {
+	net.Conn
+	link *Link
+
+	writes   chan segment // to the connection, by writeLoop
+	reads    chan segment // from the connection, by readLoop
+	closed   chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	err      error     // of the delivery of the writes
+	deadline time.Time // of the reads
+	wake     chan struct{}
+
+	readMu  sync.Mutex
+	pending segment // received, the rest of its data is returned by the next reads
+}
+
+func newConn(link *Link, c net.Conn) *conn {
+	ret := &conn{
+		Conn:   c,
+		link:   link,
+		writes: make(chan segment, 1024),
+		reads:  make(chan segment, 1024),
+		closed: make(chan struct{}),
+		wake:   make(chan struct{}, 1),
+	}
+	go ret.writeLoop()
+	go ret.readLoop()
+	return ret
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		if err := c.writeErr(); err != nil {
+			return n, err
+		}
+		size := min(len(b), segmentSize)
+		sent := c.link.up.reserve(size)
+		seg := segment{data: bytes.Clone(b[:size]), at: sent.Add(c.link.delay())}
+		// the writer is held while the link is busy with the bytes buffered before
+		if !c.sleepUntil(c.link.up.release(sent)) {
+			return n, net.ErrClosed
+		}
+		select {
+		case c.writes <- seg:
+		case <-c.closed:
+			return n, net.ErrClosed
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+func (c *conn) writeLoop() {
+	var last time.Time
+	for {
+		var seg segment
+		select {
+		case seg = <-c.writes:
+		case <-c.closed:
+			return
+		}
+		// the stream is delivered in order
+		last = later(seg.at, last)
+		if !c.sleepUntil(last) {
+			return
+		}
+		if _, err := c.Conn.Write(seg.data); err != nil {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			_ = c.Close()
+			return
+		}
+	}
+}
+
+func (c *conn) writeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *conn) readLoop() {
+	var last time.Time
+	for {
+		buf := make([]byte, segmentSize)
+		n, err := c.Conn.Read(buf)
+		seg := segment{err: err}
+		if n > 0 {
+			// the sender is held while the link is busy with the bytes buffered before
+			sent := c.link.down.reserve(n)
+			seg.data = buf[:n]
+			seg.at = sent.Add(c.link.delay())
+			if !c.sleepUntil(c.link.down.release(sent)) {
+				return
+			}
+		}
+		last = later(seg.at, last)
+		seg.at = last
+		select {
+		case c.reads <- seg:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.pending.data) == 0 {
+		if c.pending.err != nil {
+			return 0, c.pending.err
+		}
+		if err := c.receive(); err != nil {
+			return 0, err
+		}
+	}
+	if err := c.waitRead(c.pending.at); err != nil {
+		return 0, err
+	}
+	n := copy(b, c.pending.data)
+	c.pending.data = c.pending.data[n:]
+	return n, nil
+}
+
+// receive takes the next segment from the connection, the caller holds c.readMu.
+func (c *conn) receive() error {
+	for {
+		timeout, stop := c.deadlineTimer()
+		select {
+		case c.pending = <-c.reads:
+			stop()
+			return nil
+		case <-c.closed:
+			stop()
+			return net.ErrClosed
+		case <-timeout:
+			return os.ErrDeadlineExceeded
+		case <-c.wake:
+			stop() // the deadline is changed
+		}
+	}
+}
+
+// waitRead waits until t, the read deadline or the closing of the connection.
+func (c *conn) waitRead(t time.Time) error {
+	for {
+		d := time.Until(t)
+		if d <= 0 {
+			return nil
+		}
+		timeout, stop := c.deadlineTimer()
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+			stop()
+			return nil
+		case <-c.closed:
+			stop()
+			timer.Stop()
+			return net.ErrClosed
+		case <-timeout:
+			timer.Stop()
+			return os.ErrDeadlineExceeded
+		case <-c.wake:
+			stop()
+			timer.Stop()
+		}
+	}
+}
+
+// deadlineTimer returns a channel receiving once the read deadline is passed,
+// nil if there is none, and the function releasing it.
+func (c *conn) deadlineTimer() (<-chan time.Time, func()) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	if deadline.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, func() { timer.Stop() }
+}
+
+// sleepUntil waits until t, it returns false if the connection is closed first.
+func (c *conn) sleepUntil(t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+func (c *conn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline applies to the bytes arrived over the link, the connection
+// itself is read without a deadline.
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
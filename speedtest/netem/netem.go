@@ -0,0 +1,126 @@
+// Package netem emulates the conditions of a network link on in-process
+// connections: a limited bandwidth, an added latency with jitter and lost
+// segments. Combined with a local server, it runs the tests offline against
+// a known link, e.g. 20 Mbps with 80 ms of latency.
+package netem
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest/transport"
+)
+
+const (
+	segmentSize = 16 * 1024              // bytes shaped at once
+	bufferSize  = 64 * 1024              // bytes queued on the link ahead of the sender, like a socket buffer
+	minRTO      = 200 * time.Millisecond // minimum retransmission timeout of a lost segment
+)
+
+// Profile describes the conditions of an emulated link.
+type Profile struct {
+	Downlink int64         // bytes per second read by the client, 0 is unlimited
+	Uplink   int64         // bytes per second written by the client, 0 is unlimited
+	Latency  time.Duration // added round-trip time, half of it delays each direction
+	Jitter   time.Duration // each segment is delayed by up to ±Jitter/2 more in each direction
+	Loss     float64       // probability that a segment is lost and retransmitted, 0 to 1
+}
+
+// Mbps returns the bytes per second of a bandwidth in megabits per second.
+func Mbps(mbps float64) int64 {
+	return int64(mbps * 1000 * 1000 / 8)
+}
+
+// Link emulates a Profile on the connections it wraps. The connections share
+// the bandwidth of the link like the connections of a real one, and each one
+// delivers its bytes in order: a lost segment delays the segments after it by
+// the retransmission timeout, the bytes themselves are never dropped.
+type Link struct {
+	profile Profile
+	down    pacer
+	up      pacer
+}
+
+// NewLink returns a link with the conditions of the profile.
+func NewLink(profile Profile) *Link {
+	return &Link{
+		profile: profile,
+		down:    pacer{rate: profile.Downlink},
+		up:      pacer{rate: profile.Uplink},
+	}
+}
+
+// Profile returns the conditions of the link.
+func (l *Link) Profile() Profile {
+	return l.profile
+}
+
+// Conn returns conn carried over the link.
+func (l *Link) Conn(conn net.Conn) net.Conn {
+	return newConn(l, conn)
+}
+
+// delay returns the one-way delay of a segment.
+func (l *Link) delay() time.Duration {
+	d := l.profile.Latency / 2
+	if j := l.profile.Jitter; j > 0 {
+		d += time.Duration(rand.Int64N(int64(j)+1)) - j/2
+	}
+	if l.profile.Loss > 0 && rand.Float64() < l.profile.Loss {
+		d += max(minRTO, l.profile.Latency+2*l.profile.Jitter)
+	}
+	return max(d, 0)
+}
+
+// pacer serializes the bytes of a direction of the link at its rate.
+type pacer struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time // the link is busy until then
+}
+
+// reserve returns when n bytes are through the link, after the bytes reserved before.
+func (p *pacer) reserve(n int) time.Time {
+	now := time.Now()
+	if p.rate <= 0 {
+		return now
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start := now
+	if p.next.After(now) {
+		start = p.next
+	}
+	p.next = start.Add(time.Duration(float64(n) / float64(p.rate) * float64(time.Second)))
+	return p.next
+}
+
+// release returns when a sender is let go after the bytes through the link at
+// sent, once the bytes queued ahead of them fit in the buffer.
+func (p *pacer) release(sent time.Time) time.Time {
+	if p.rate <= 0 {
+		return sent
+	}
+	return sent.Add(-time.Duration(float64(bufferSize) / float64(p.rate) * float64(time.Second)))
+}
+
+// Dialer dials connections carried over a link.
+type Dialer struct {
+	Link   *Link
+	Dialer transport.Dialer // dials the connections, a net.Dialer if nil
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer transport.Dialer = &net.Dialer{}
+	if d.Dialer != nil {
+		dialer = d.Dialer
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return d.Link.Conn(conn), nil
+}
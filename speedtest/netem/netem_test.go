@@ -0,0 +1,173 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listen returns the address of a loopback server running serve on each connection.
+func listen(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func echo(conn net.Conn) {
+	_, _ = io.Copy(conn, conn)
+}
+
+func dial(t *testing.T, link *Link, addr string) net.Conn {
+	t.Helper()
+	conn, err := (&Dialer{Link: link}).DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestLatency(t *testing.T) {
+	const latency = 80 * time.Millisecond
+	conn := dial(t, NewLink(Profile{Latency: latency}), listen(t, echo))
+
+	buf := make([]byte, 4)
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if rtt := time.Since(start); rtt < latency || rtt > latency+20*time.Millisecond {
+			t.Errorf("got a round trip of %v, want %v", rtt, latency)
+		}
+		if string(buf) != "ping" {
+			t.Errorf("got %q, want ping", buf)
+		}
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	const size = 512 * 1024
+	payload := make([]byte, size)
+	addr := listen(t, func(conn net.Conn) {
+		_, _ = conn.Write(payload)
+	})
+	// the connections share the bandwidth of the link
+	link := NewLink(Profile{Downlink: Mbps(16)})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		conn := dial(t, link, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(io.Discard, conn)
+			if err != nil || n != size {
+				t.Errorf("got %d bytes, %v, want %d", n, err, size)
+			}
+		}()
+	}
+	wg.Wait()
+	want := time.Duration(float64(2*size) / float64(Mbps(16)) * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < want*9/10 || elapsed > want*11/10 {
+		t.Errorf("got %v to read %d bytes, want %v", elapsed, 2*size, want)
+	}
+}
+
+func TestUplink(t *testing.T) {
+	const size = 256 * 1024
+	received := make(chan int64, 1)
+	addr := listen(t, func(conn net.Conn) {
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	})
+	conn := dial(t, NewLink(Profile{Uplink: Mbps(8), Latency: 40 * time.Millisecond}), addr)
+
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	// the writer is held until the last bytes fit in the buffer
+	want := time.Duration(float64(size-bufferSize) / float64(Mbps(8)) * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < want*9/10 || elapsed > want*11/10 {
+		t.Errorf("got %v to write %d bytes, want %v", elapsed, size, want)
+	}
+	// the bytes in flight are delivered before the close
+	time.Sleep(100 * time.Millisecond)
+	_ = conn.Close()
+	if n := <-received; n != size {
+		t.Errorf("the server received %d bytes, want %d", n, size)
+	}
+}
+
+func TestLoss(t *testing.T) {
+	link := NewLink(Profile{Latency: 20 * time.Millisecond, Loss: 1})
+	// a lost segment is delayed by the retransmission timeout
+	if d := link.delay(); d != 10*time.Millisecond+minRTO {
+		t.Errorf("got a delay of %v, want %v", d, 10*time.Millisecond+minRTO)
+	}
+	link = NewLink(Profile{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	for i := 0; i < 100; i++ {
+		if d := link.delay(); d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Fatalf("got a delay of %v, want 10ms±5ms", d)
+		}
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	conn := dial(t, NewLink(Profile{Latency: 200 * time.Millisecond}), listen(t, echo))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	// the bytes are not arrived before the deadline
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 4)
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want a deadline error", err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("got %q, %v, want ping", buf, err)
+	}
+
+	// a read in progress is interrupted by the close
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(buf)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_ = conn.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("got %v, want net.ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the read is not interrupted by the close")
+	}
+}
@@ -0,0 +1,79 @@
+package speedtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest/netem"
+)
+
+func TestEmulatedLink(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the tests over an emulated link")
+	}
+	ts := newSpeedtestStandIn(1024 * 1024)
+	defer ts.Close()
+
+	const latency = 80 * time.Millisecond
+	rate := ByteRate(netem.Mbps(20))
+	link := netem.NewLink(netem.Profile{Downlink: netem.Mbps(20), Uplink: netem.Mbps(20), Latency: latency})
+	c := New(WithUserConfig(&UserConfig{WrapConn: link.Conn}))
+	// the connections keep the link busy during the round trips between the requests
+	c.SetNThread(4)
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = server.PingTest(nil); err != nil {
+		t.Fatal(err)
+	}
+	if server.Latency < latency || server.Latency >= latency+20*time.Millisecond {
+		t.Errorf("got a latency of %v, want %v", server.Latency, latency)
+	}
+
+	if err = server.DownloadTest(); err != nil {
+		t.Fatal(err)
+	}
+	if reason := server.DLStats.Quality.StopReason; reason != StopConverged {
+		t.Errorf("got the download stopped by %s, want %s", reason, StopConverged)
+	}
+	if server.DLSpeed < rate*9/10 || server.DLSpeed > rate*11/10 {
+		t.Errorf("got a download of %v, want %v", server.DLSpeed, rate)
+	}
+
+	c.SetUploadStopPolicy(StopPolicy{Mode: StopDuration, Duration: 3 * time.Second})
+	if err = server.UploadTest(); err != nil {
+		t.Fatal(err)
+	}
+	if server.ULSpeed < rate*9/10 || server.ULSpeed > rate*11/10 {
+		t.Errorf("got an upload of %v, want %v", server.ULSpeed, rate)
+	}
+}
+
+func TestEmulatedSlowLink(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the tests over an emulated link")
+	}
+	ts := newSpeedtestStandIn(4 * 1024 * 1024)
+	defer ts.Close()
+
+	link := netem.NewLink(netem.Profile{Downlink: netem.Mbps(5), Uplink: netem.Mbps(5), Latency: 60 * time.Millisecond})
+	c := New(WithUserConfig(&UserConfig{WrapConn: link.Conn}))
+	c.SetNThread(4)
+	// no request completes before the end of the test, all of them are canceled
+	c.SetDownloadStopPolicy(StopPolicy{Mode: StopDuration, Duration: 3 * time.Second})
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.DownloadTest(); err != nil {
+		t.Fatal(err)
+	}
+	if q := server.DLStats.Quality; q.Errors != 0 || q.ErrorRatio != 0 {
+		t.Errorf("got %d/%d errors, want the canceled requests not counted", q.Errors, q.Requests)
+	}
+	if server.DLSpeed <= 0 {
+		t.Errorf("got a download of %v", server.DLSpeed)
+	}
+}
@@ -7,15 +7,25 @@ import (
 )
 
 type fullOutput struct {
-	Timestamp outputTime `json:"timestamp"`
-	UserInfo  *User      `json:"user_info"`
-	Servers   Servers    `json:"servers"`
+	Timestamp    outputTime               `json:"timestamp"`
+	UserInfo     *User                    `json:"user_info"`
+	Servers      Servers                  `json:"servers"`
+	ResolveTimes map[string]time.Duration `json:"resolve_times,omitempty"`
+	Aggregate    *Aggregate               `json:"aggregate,omitempty"`
+	Partial      bool                     `json:"partial,omitempty"`
 }
 
 type singleServerOutput struct {
+	Timestamp    outputTime               `json:"timestamp"`
+	UserInfo     *User                    `json:"user_info"`
+	Server       *Server                  `json:"server"`
+	ResolveTimes map[string]time.Duration `json:"resolve_times,omitempty"`
+	Partial      bool                     `json:"partial,omitempty"`
+}
+
+type aggregateOutput struct {
 	Timestamp outputTime `json:"timestamp"`
-	UserInfo  *User      `json:"user_info"`
-	Server    *Server    `json:"server"`
+	Aggregate Aggregate  `json:"aggregate"`
 }
 
 type outputTime time.Time
@@ -25,12 +35,30 @@ func (t outputTime) MarshalJSON() ([]byte, error) {
 	return []byte(stamp), nil
 }
 
+// JSON outputs the results of the servers in JSON format, it is partial if one of them is.
 func (s *Speedtest) JSON(servers Servers) ([]byte, error) {
+	return s.json(servers, nil)
+}
+
+// ParallelJSON outputs the results of the servers tested at the same time
+// and their aggregate in JSON format, see Servers.RunParallel.
+func (s *Speedtest) ParallelJSON(servers Servers, aggregate Aggregate) ([]byte, error) {
+	return s.json(servers, &aggregate)
+}
+
+func (s *Speedtest) json(servers Servers, aggregate *Aggregate) ([]byte, error) {
+	partial := false
+	for _, server := range servers {
+		partial = partial || server.Partial
+	}
 	return json.Marshal(
 		fullOutput{
-			Timestamp: outputTime(time.Now()),
-			UserInfo:  s.User,
-			Servers:   servers,
+			Timestamp:    outputTime(time.Now()),
+			UserInfo:     s.User,
+			Servers:      servers,
+			ResolveTimes: s.ResolveTimes(),
+			Aggregate:    aggregate,
+			Partial:      partial,
 		},
 	)
 }
@@ -39,9 +67,17 @@ func (s *Speedtest) JSON(servers Servers) ([]byte, error) {
 func (s *Speedtest) JSONL(server *Server) ([]byte, error) {
 	return json.Marshal(
 		singleServerOutput{
-			Timestamp: outputTime(time.Now()),
-			UserInfo:  s.User,
-			Server:    server,
+			Timestamp:    outputTime(time.Now()),
+			UserInfo:     s.User,
+			Server:       server,
+			ResolveTimes: s.ResolveTimes(),
+			Partial:      server.Partial,
 		},
 	)
 }
+
+// JSONLAggregate outputs the aggregate of the servers tested at the same time
+// in JSON format, the line following their JSONL lines.
+func (s *Speedtest) JSONLAggregate(aggregate Aggregate) ([]byte, error) {
+	return json.Marshal(aggregateOutput{Timestamp: outputTime(time.Now()), Aggregate: aggregate})
+}
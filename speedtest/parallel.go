@@ -0,0 +1,90 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest/transport"
+)
+
+// Aggregate combines the results of servers tested at the same time. The
+// rates add up to the throughput of the link over the overlapping tests,
+// the latencies are the means over the servers that measured one and the
+// packet loss adds up the packets of the servers that sent some.
+type Aggregate struct {
+	Servers    int             `json:"servers"`
+	Failed     int             `json:"failed,omitempty"` // servers with a failed phase
+	DLSpeed    ByteRate        `json:"dl_speed"`
+	ULSpeed    ByteRate        `json:"ul_speed"`
+	Latency    time.Duration   `json:"latency"`
+	Jitter     time.Duration   `json:"jitter"`
+	PacketLoss transport.PLoss `json:"packet_loss"`
+	Partial    bool            `json:"partial,omitempty"`
+}
+
+// ParallelResult is the outcome of Servers.RunParallel, the Results are in the order of the servers.
+type ParallelResult struct {
+	Results   []Result  `json:"results"`
+	Aggregate Aggregate `json:"aggregate"`
+}
+
+// AggregateResults returns the aggregate of the results of servers tested at the same time.
+func AggregateResults(results []Result) Aggregate {
+	a := Aggregate{Servers: len(results)}
+	var latency, jitter time.Duration
+	pinged := 0
+	for _, r := range results {
+		if len(r.Errors) > 0 {
+			a.Failed++
+		}
+		if r.DLSpeed > 0 {
+			a.DLSpeed += r.DLSpeed
+		}
+		if r.ULSpeed > 0 {
+			a.ULSpeed += r.ULSpeed
+		}
+		if r.Latency > 0 {
+			latency += r.Latency
+			jitter += r.Jitter
+			pinged++
+		}
+		if r.PacketLoss.Sent > 0 {
+			a.PacketLoss.Sent += r.PacketLoss.Sent
+			a.PacketLoss.Dup += r.PacketLoss.Dup
+			a.PacketLoss.Max += r.PacketLoss.Max
+		}
+		a.Partial = a.Partial || r.Partial
+	}
+	if pinged > 0 {
+		a.Latency = latency / time.Duration(pinged)
+		a.Jitter = jitter / time.Duration(pinged)
+	}
+	return a
+}
+
+// RunParallel runs the given phases against all the servers at the same
+// time, see Server.Run. A server without a manager of its own is given one
+// by Speedtest.NewManager, so the tests do not share any state. The servers
+// share the data budget of the client: the tests of a phase draw from its
+// allotment together. The errors of the servers are joined in the returned
+// error.
+func (servers Servers) RunParallel(ctx context.Context, phases ...Phase) (*ParallelResult, error) {
+	ret := &ParallelResult{Results: make([]Result, len(servers))}
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		if server.manager == nil {
+			server.SetManager(server.Context.NewManager())
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ret.Results[i], errs[i] = server.Run(ctx, phases...)
+		}()
+	}
+	wg.Wait()
+	ret.Aggregate = AggregateResults(ret.Results)
+	return ret, errors.Join(errs...)
+}
@@ -0,0 +1,120 @@
+package speedtest
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest/transport"
+)
+
+func TestRunParallel(t *testing.T) {
+	c := New()
+	c.SetCaptureTime(time.Second)
+	var servers Servers
+	for _, size := range []int{256 * 1024, 64 * 1024} {
+		ts := newSpeedtestStandIn(size)
+		defer ts.Close()
+		server, err := c.CustomServer(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, server)
+	}
+
+	pr, err := servers.RunParallel(context.Background(), PhasePing, PhaseDownload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pr.Results) != 2 {
+		t.Fatalf("got %d results, want 2", len(pr.Results))
+	}
+	var sum ByteRate
+	var usage int64
+	for i, r := range pr.Results {
+		server := servers[i]
+		if r.Server.URL != server.URL || r.DLSpeed <= 0 || r.Latency <= 0 {
+			t.Errorf("got unexpected result %+v of %s", r, server.URL)
+		}
+		if server.Manager() == c.Manager || server.Manager().GetTotalDownload() == 0 {
+			t.Errorf("the server %s did not test with its own manager", server.URL)
+		}
+		if r.DataUsage[PhaseDownload] <= 0 {
+			t.Errorf("got no download usage for %s", server.URL)
+		}
+		sum += r.DLSpeed
+		usage += r.DataUsage[PhasePing] + r.DataUsage[PhaseDownload]
+	}
+	if servers[0].Manager() == servers[1].Manager() {
+		t.Error("the servers share a manager")
+	}
+	if c.GetTotalDownload() != 0 {
+		t.Errorf("the client manager counted %d bytes", c.GetTotalDownload())
+	}
+	// each server counts the bytes of its own connections only
+	if total := atomic.LoadInt64(&c.wireBytes); usage != total {
+		t.Errorf("the usage of the servers adds up to %d, the client moved %d", usage, total)
+	}
+	if pr.Aggregate.Servers != 2 || pr.Aggregate.Failed != 0 || pr.Aggregate.DLSpeed != sum || pr.Aggregate.Latency <= 0 {
+		t.Errorf("got unexpected aggregate %+v", pr.Aggregate)
+	}
+}
+
+func TestRunParallelBudget(t *testing.T) {
+	const limit = 8 * MB
+	c := New(WithDoer(&http.Client{}), WithUserConfig(&UserConfig{MaxData: limit}))
+	c.SetCaptureTime(10 * time.Second)
+	budget := c.GetDataBudget()
+	var servers Servers
+	for range 3 {
+		ts := newSpeedtestStandIn(256 * 1024)
+		defer ts.Close()
+		server, err := c.CustomServer(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, server)
+	}
+
+	pr, err := servers.RunParallel(context.Background(), PhaseDownload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the servers share the download allotment instead of taking it each
+	var usage int64
+	for _, r := range pr.Results {
+		usage += r.DataUsage[PhaseDownload]
+	}
+	if used, allotment := budget.Used(PhaseDownload), budget.Allotment(PhaseDownload); used != usage || used > allotment {
+		t.Errorf("the servers used %d bytes, booked %d of the %d allotment", usage, used, allotment)
+	}
+	if budget.Remaining(PhaseDownload) > budget.Allotment(PhaseDownload)/10 {
+		t.Errorf("%d bytes of the allotment are left", budget.Remaining(PhaseDownload))
+	}
+}
+
+func TestAggregateResults(t *testing.T) {
+	a := AggregateResults([]Result{
+		{DLSpeed: 100, ULSpeed: 10, Latency: 10 * time.Millisecond, Jitter: 2 * time.Millisecond, PacketLoss: transport.PLoss{Sent: 9, Max: 9}},
+		{DLSpeed: -1, ULSpeed: 20, Errors: map[Phase]string{PhaseDownload: "failed"}, PacketLoss: transport.PLoss{Sent: 18, Dup: 1, Max: 19}},
+		{DLSpeed: 50, Latency: 20 * time.Millisecond, Jitter: 4 * time.Millisecond, Partial: true},
+	})
+	want := Aggregate{
+		Servers:    3,
+		Failed:     1,
+		DLSpeed:    150,
+		ULSpeed:    30,
+		Latency:    15 * time.Millisecond,
+		Jitter:     3 * time.Millisecond,
+		PacketLoss: transport.PLoss{Sent: 27, Dup: 1, Max: 28},
+		Partial:    true,
+	}
+	if a != want {
+		t.Errorf("got %+v, want %+v", a, want)
+	}
+	if (AggregateResults(nil) != Aggregate{}) {
+		t.Error("the aggregate of no results is not empty")
+	}
+}
@@ -0,0 +1,62 @@
+package speedtest
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+)
+
+// Payload selects the bytes of the upload bodies.
+type Payload int
+
+const (
+	// PayloadRandom sends pseudo-random bytes that compressing proxies, WAN
+	// optimizers and VPNs can not shrink, it is the default.
+	PayloadRandom Payload = iota
+	// PayloadPattern sends a repeated 0xAA pattern, the behaviour of the older releases.
+	PayloadPattern
+)
+
+func (p Payload) String() string {
+	if p == PayloadPattern {
+		return "pattern"
+	}
+	return "random"
+}
+
+// ParsePayload parses a payload name, random or pattern.
+func ParsePayload(str string) (Payload, error) {
+	switch strings.ToLower(str) {
+	case "", "random":
+		return PayloadRandom, nil
+	case "pattern":
+		return PayloadPattern, nil
+	}
+	return PayloadRandom, fmt.Errorf("unknown payload %q, expected random or pattern", str)
+}
+
+// randomPoolSize is far larger than the window of the common stream
+// compressors (deflate 32KiB, lz4 64KiB), so the repetition of the pool
+// is not found either.
+const randomPoolSize = 4 << 20
+
+// randomPool is generated once per process and shared by the upload bodies,
+// each body starts reading at a random offset.
+var randomPool = sync.OnceValue(func() []byte {
+	var seed [32]byte
+	_, _ = crand.Read(seed[:])
+	pool := make([]byte, randomPoolSize)
+	_, _ = rand.NewChaCha8(seed).Read(pool)
+	return pool
+})
+
+// payloadAt returns the bytes of the upload body from the offset of the chunk.
+func (dc *DataChunk) payloadAt() []byte {
+	if dc.payload == PayloadPattern {
+		return *dc.manager.repeatByte
+	}
+	pool := randomPool()
+	return pool[dc.offset%int64(len(pool)):]
+}
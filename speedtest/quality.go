@@ -0,0 +1,75 @@
+package speedtest
+
+import (
+	"fmt"
+)
+
+// StopReason tells why a download or upload test ended.
+type StopReason string
+
+const (
+	StopConverged StopReason = "converged" // the rate was stable, StopAuto only
+	StopTimeout   StopReason = "timeout"   // the capture time ran out before the rate was stable, or MaxVolumeDuration before the volume was reached
+	StopElapsed   StopReason = "duration"  // the duration of StopDuration was reached
+	StopReached   StopReason = "volume"    // the volume of StopVolume was reached
+	StopBudget    StopReason = "budget"    // the data budget was spent
+	StopCanceled  StopReason = "canceled"  // the context was canceled, the rate is partial
+)
+
+// Grade is a coarse verdict on the trustworthiness of a measurement.
+type Grade string
+
+const (
+	GradeGood Grade = "good"
+	GradeFair Grade = "fair"
+	GradePoor Grade = "poor"
+)
+
+const (
+	minQualitySamples = 20   // samples of the measured part, 1s at the default frequency
+	maxFairCV         = 0.1  // coefficient of variation of a fair measurement
+	maxGoodErrorRatio = 0.01 // failed requests of a good measurement
+	maxFairErrorRatio = 0.1
+)
+
+// Quality describes how much a download or upload rate can be trusted.
+type Quality struct {
+	StopReason StopReason `json:"stop_reason"`
+	Converged  bool       `json:"converged"` // the rate was stable when the test ended
+	CV         float64    `json:"cv"`        // coefficient of variation of the rate at the end
+	Samples    int        `json:"samples"`   // rate samples of the measured part, after the warm-up
+	Requests   int64      `json:"requests"`
+	Errors     int64      `json:"errors"`
+	ErrorRatio float64    `json:"error_ratio"`
+	Grade      Grade      `json:"grade"`
+}
+
+// countRequests sets the request counts and grades the measurement.
+func (q *Quality) countRequests(requests, errors int64) {
+	q.Requests, q.Errors = requests, errors
+	q.ErrorRatio = 0
+	if requests > 0 {
+		q.ErrorRatio = float64(errors) / float64(requests)
+	}
+	q.Grade = q.grade()
+}
+
+func (q *Quality) grade() Grade {
+	switch {
+	case q.Samples < minQualitySamples || q.ErrorRatio > maxFairErrorRatio:
+		return GradePoor
+	case q.Converged && q.ErrorRatio <= maxGoodErrorRatio:
+		return GradeGood
+	case q.CV <= maxFairCV:
+		return GradeFair
+	}
+	return GradePoor
+}
+
+func (q Quality) String() string {
+	stop := string(q.StopReason)
+	if !q.Converged && q.StopReason != StopTimeout {
+		stop += ", unstable"
+	}
+	return fmt.Sprintf("Quality: %s (%s, CV: %.2f%%, Samples: %d, Errors: %d/%d)", q.Grade, stop, q.CV*100, q.Samples, q.Errors, q.Requests)
+}
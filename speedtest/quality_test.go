@@ -0,0 +1,31 @@
+package speedtest
+
+import (
+	"testing"
+)
+
+func TestQualityGrade(t *testing.T) {
+	cases := []struct {
+		quality  Quality
+		requests int64
+		errors   int64
+		expected Grade
+	}{
+		{Quality{StopReason: StopConverged, Converged: true, CV: 0.01, Samples: 200}, 100, 0, GradeGood},
+		{Quality{StopReason: StopConverged, Converged: true, CV: 0.01, Samples: 200}, 100, 5, GradeFair},
+		{Quality{StopReason: StopTimeout, CV: 0.05, Samples: 300}, 100, 0, GradeFair},
+		{Quality{StopReason: StopTimeout, CV: 0.3, Samples: 300}, 100, 0, GradePoor},
+		{Quality{StopReason: StopConverged, Converged: true, CV: 0.01, Samples: 200}, 100, 20, GradePoor},
+		{Quality{StopReason: StopBudget, Converged: true, CV: 0.01, Samples: 5}, 10, 0, GradePoor},
+	}
+	for i, c := range cases {
+		q := c.quality
+		q.countRequests(c.requests, c.errors)
+		if q.Grade != c.expected {
+			t.Errorf("case %d: got grade %s, expected %s", i, q.Grade, c.expected)
+		}
+		if c.requests > 0 && q.ErrorRatio != float64(c.errors)/float64(c.requests) {
+			t.Errorf("case %d: got unexpected error ratio %v", i, q.ErrorRatio)
+		}
+	}
+}
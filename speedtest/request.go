@@ -3,13 +3,11 @@ package speedtest
 import (
 	"context"
 	"errors"
-	"fmt"
 	"github.com/showwin/speedtest-go/speedtest/transport"
 	"io"
 	"math"
 	"net/http"
 	"net/url"
-	"path"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -26,17 +24,24 @@ var (
 )
 
 var (
-	ErrConnectTimeout = errors.New("server connect timeout")
+	ErrConnectTimeout     = errors.New("server connect timeout")
+	ErrNoAvailableServers = errors.New("not found available servers")
 )
 
 func (s *Server) MultiDownloadTestContext(ctx context.Context, servers Servers) error {
+	defer s.trackUsage(PhaseDownload)()
+	end := s.startPhase(PhaseDownload)
+	s.markHTTP3Bypass()
 	ss := servers.Available()
 	if ss.Len() == 0 {
-		return errors.New("not found available servers")
+		err := wrapError(PhaseDownload, s.ID, ErrNoAvailableServers)
+		end(err)
+		return err
 	}
 	mainIDIndex := 0
 	var td *TestDirection
-	_context, cancel := context.WithCancel(ctx)
+	tracer := newConnTracer()
+	_context, cancel := context.WithCancel(withConnTracer(ctx, tracer))
 	defer cancel()
 	var errorTimes int64 = 0
 	var requestTimes int64 = 0
@@ -44,34 +49,61 @@ func (s *Server) MultiDownloadTestContext(ctx context.Context, servers Servers)
 		if server.ID == s.ID {
 			mainIDIndex = i
 		}
-		sp := server
-		dbg.Printf("Register Download Handler: %s\n", sp.URL)
-		td = server.Context.RegisterDownloadHandler(func() {
+		// the requests of all the servers count into the manager and usage of s
+		sp := server.testCopy()
+		sp.manager, sp.wireBytes = s.manager, s.wireBytes
+		s.Context.logger.Debug("register download handler", "server", sp.ID, "url", sp.URL)
+		td = s.Manager().RegisterDownloadHandler(func() {
 			atomic.AddInt64(&requestTimes, 1)
-			if err := downloadRequest(_context, sp, 3); err != nil {
+			if err := downloadRequest(sp.withEventMeta(_context, PhaseDownload), sp, 3); err != nil && _context.Err() == nil {
 				atomic.AddInt64(&errorTimes, 1)
+				sp.requestFailed(_context, PhaseDownload, err)
 			}
 		})
 	}
 	if td == nil {
-		return ErrorUninitializedManager
+		err := wrapError(PhaseDownload, s.ID, ErrorUninitializedManager)
+		end(err)
+		return err
+	}
+	s.observeTransfer(td, PhaseDownload)
+	td.StartContext(ctx, cancel, mainIDIndex) // block here
+	td.onTick = nil
+	s.DLSpeed = ByteRate(td.Rate())
+	s.DLStats = td.Stats()
+	s.DLStats.Quality.countRequests(requestTimes, errorTimes)
+	s.Timing.Download = tracer.Timing()
+	s.observeTLS(tracer)
+	if s.DLStats.Quality.StopReason == StopCanceled {
+		s.Partial = true
+		err := wrapError(PhaseDownload, s.ID, ctx.Err())
+		end(err)
+		return err
 	}
-	td.Start(cancel, mainIDIndex) // block here
-	s.DLSpeed = ByteRate(td.manager.GetEWMADownloadRate())
 	if s.DLSpeed == 0 && float64(errorTimes)/float64(requestTimes) > 0.1 {
 		s.DLSpeed = -1 // N/A
+		err := wrapError(PhaseDownload, s.ID, ErrTransferFailed)
+		end(err)
+		return err
 	}
+	end(nil)
 	return nil
 }
 
 func (s *Server) MultiUploadTestContext(ctx context.Context, servers Servers) error {
+	defer s.trackUsage(PhaseUpload)()
+	end := s.startPhase(PhaseUpload)
+	s.markHTTP3Bypass()
 	ss := servers.Available()
 	if ss.Len() == 0 {
-		return errors.New("not found available servers")
+		err := wrapError(PhaseUpload, s.ID, ErrNoAvailableServers)
+		end(err)
+		return err
 	}
 	mainIDIndex := 0
 	var td *TestDirection
-	_context, cancel := context.WithCancel(ctx)
+	tracer := newConnTracer()
+	_context, cancel := context.WithCancel(withConnTracer(ctx, tracer))
 	defer cancel()
 	var errorTimes int64 = 0
 	var requestTimes int64 = 0
@@ -79,23 +111,44 @@ func (s *Server) MultiUploadTestContext(ctx context.Context, servers Servers) er
 		if server.ID == s.ID {
 			mainIDIndex = i
 		}
-		sp := server
-		dbg.Printf("Register Upload Handler: %s\n", sp.URL)
-		td = server.Context.RegisterUploadHandler(func() {
+		// the requests of all the servers count into the manager and usage of s
+		sp := server.testCopy()
+		sp.manager, sp.wireBytes = s.manager, s.wireBytes
+		s.Context.logger.Debug("register upload handler", "server", sp.ID, "url", sp.URL)
+		td = s.Manager().RegisterUploadHandler(func() {
 			atomic.AddInt64(&requestTimes, 1)
-			if err := uploadRequest(_context, sp, 3); err != nil {
+			if err := uploadRequest(sp.withEventMeta(_context, PhaseUpload), sp, 3); err != nil && _context.Err() == nil {
 				atomic.AddInt64(&errorTimes, 1)
+				sp.requestFailed(_context, PhaseUpload, err)
 			}
 		})
 	}
 	if td == nil {
-		return ErrorUninitializedManager
+		err := wrapError(PhaseUpload, s.ID, ErrorUninitializedManager)
+		end(err)
+		return err
+	}
+	s.observeTransfer(td, PhaseUpload)
+	td.StartContext(ctx, cancel, mainIDIndex) // block here
+	td.onTick = nil
+	s.ULSpeed = ByteRate(td.Rate())
+	s.ULStats = td.Stats()
+	s.ULStats.Quality.countRequests(requestTimes, errorTimes)
+	s.Timing.Upload = tracer.Timing()
+	s.observeTLS(tracer)
+	if s.ULStats.Quality.StopReason == StopCanceled {
+		s.Partial = true
+		err := wrapError(PhaseUpload, s.ID, ctx.Err())
+		end(err)
+		return err
 	}
-	td.Start(cancel, mainIDIndex) // block here
-	s.ULSpeed = ByteRate(td.manager.GetEWMAUploadRate())
 	if s.ULSpeed == 0 && float64(errorTimes)/float64(requestTimes) > 0.1 {
 		s.ULSpeed = -1 // N/A
+		err := wrapError(PhaseUpload, s.ID, ErrTransferFailed)
+		end(err)
+		return err
 	}
+	end(nil)
 	return nil
 }
 
@@ -110,24 +163,16 @@ func (s *Server) DownloadTestContext(ctx context.Context) error {
 }
 
 func (s *Server) downloadTestContext(ctx context.Context, downloadRequest downloadFunc) error {
-	var errorTimes int64 = 0
-	var requestTimes int64 = 0
-	start := time.Now()
-	_context, cancel := context.WithCancel(ctx)
-	s.Context.RegisterDownloadHandler(func() {
-		atomic.AddInt64(&requestTimes, 1)
-		if err := downloadRequest(_context, s, 3); err != nil {
-			atomic.AddInt64(&errorTimes, 1)
-		}
-	}).Start(cancel, 0)
-	duration := time.Since(start)
-	s.DLSpeed = ByteRate(s.Context.GetEWMADownloadRate())
-	if s.DLSpeed == 0 && float64(errorTimes)/float64(requestTimes) > 0.1 {
-		s.DLSpeed = -1 // N/A
-	}
-	s.TestDuration.Download = &duration
+	defer s.trackUsage(PhaseDownload)()
+	s.markHTTP3Bypass()
+	r := s.runTransfer(ctx, PhaseDownload, s.Manager().RegisterDownloadHandler, downloadRequest, 3)
+	s.DLSpeed = r.rate
+	s.DLStats = r.stats
+	s.TestDuration.Download = &r.duration
+	s.Timing.Download = r.tracer.Timing()
+	s.observeTLS(r.tracer)
 	s.testDurationTotalCount()
-	return nil
+	return r.err
 }
 
 // UploadTest executes the test to measure upload speed
@@ -141,60 +186,115 @@ func (s *Server) UploadTestContext(ctx context.Context) error {
 }
 
 func (s *Server) uploadTestContext(ctx context.Context, uploadRequest uploadFunc) error {
+	defer s.trackUsage(PhaseUpload)()
+	s.markHTTP3Bypass()
+	r := s.runTransfer(ctx, PhaseUpload, s.Manager().RegisterUploadHandler, uploadRequest, 4)
+	s.ULSpeed = r.rate
+	s.ULStats = r.stats
+	s.TestDuration.Upload = &r.duration
+	s.Timing.Upload = r.tracer.Timing()
+	s.observeTLS(r.tracer)
+	s.testDurationTotalCount()
+	return r.err
+}
+
+// transferResult is the outcome of a download or upload test.
+type transferResult struct {
+	rate     ByteRate
+	stats    TransferStats
+	volume   int64 // payload bytes transferred
+	duration time.Duration
+	tracer   *connTracer
+	err      error // the context was canceled and the rate is partial, or the transfer failed
+}
+
+// runTransfer registers the request handler to the direction and runs the test, it blocks until the test ends.
+func (s *Server) runTransfer(ctx context.Context, phase Phase, register func(fn func()) *TestDirection, request func(context.Context, *Server, int) error, size int) transferResult {
+	end := s.startPhase(phase)
 	var errorTimes int64 = 0
 	var requestTimes int64 = 0
-	start := time.Now()
-	_context, cancel := context.WithCancel(ctx)
-	s.Context.RegisterUploadHandler(func() {
+	start := s.Context.clock.Now()
+	tracer := newConnTracer()
+	_context, cancel := context.WithCancel(withConnTracer(s.withEventMeta(ctx, phase), tracer))
+	td := register(func() {
 		atomic.AddInt64(&requestTimes, 1)
-		if err := uploadRequest(_context, s, 4); err != nil {
+		// the requests in flight when the test ends are canceled, they are not errors
+		if err := request(_context, s, size); err != nil && _context.Err() == nil {
 			atomic.AddInt64(&errorTimes, 1)
+			s.requestFailed(_context, phase, err)
 		}
-	}).Start(cancel, 0)
-	duration := time.Since(start)
-	s.ULSpeed = ByteRate(s.Context.GetEWMAUploadRate())
-	if s.ULSpeed == 0 && float64(errorTimes)/float64(requestTimes) > 0.1 {
-		s.ULSpeed = -1 // N/A
-	}
-	s.TestDuration.Upload = &duration
-	s.testDurationTotalCount()
-	return nil
+	})
+	volume := td.GetTotalDataVolume()
+	s.observeTransfer(td, phase)
+	td.StartContext(ctx, cancel, 0)
+	td.onTick = nil
+	r := transferResult{
+		rate:     ByteRate(td.Rate()),
+		stats:    td.Stats(),
+		volume:   td.GetTotalDataVolume() - volume,
+		duration: s.Context.clock.Now().Sub(start),
+		tracer:   tracer,
+	}
+	r.stats.Quality.countRequests(requestTimes, errorTimes)
+	if r.stats.Quality.StopReason == StopCanceled {
+		r.err = wrapError(phase, s.ID, ctx.Err())
+		s.Partial = true
+		end(r.err)
+		return r
+	}
+	if r.rate == 0 && float64(errorTimes)/float64(requestTimes) > 0.1 {
+		r.rate = -1 // N/A
+		r.err = wrapError(phase, s.ID, ErrTransferFailed)
+		end(r.err)
+		return r
+	}
+	end(nil)
+	return r
 }
 
 func downloadRequest(ctx context.Context, s *Server, w int) error {
-	size := dlSizes[w]
-	u, err := url.Parse(s.URL)
+	xdlURL, err := s.endpoint(s.Context.downloadURL(), s.Context.downloadSize(w))
 	if err != nil {
 		return err
 	}
-	u.Path = path.Dir(u.Path)
-	xdlURL := u.JoinPath(fmt.Sprintf("random%dx%d.jpg", size, size)).String()
-	dbg.Printf("XdlURL: %s\n", xdlURL)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, xdlURL, nil)
+	s.Context.logger.Debug("download request", "server", s.ID, "phase", PhaseDownload, "url", xdlURL)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(traceContext(ctx), http.MethodGet, xdlURL, nil)
 	if err != nil {
 		return err
 	}
 
-	resp, err := s.Context.doer.Do(req)
+	resp, err := s.Context.testDoer().Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	return s.Context.NewChunk().DownloadHandler(resp.Body)
+	chunk := s.Manager().NewChunk()
+	err = chunk.DownloadHandler(resp.Body)
+	if dc, ok := chunk.(*DataChunk); ok && dc.err == nil {
+		// the test stopped before the end of the body: the transport drains
+		// the rest of a closed body, unless the request is canceled
+		cancel()
+	}
+	return err
 }
 
 func uploadRequest(ctx context.Context, s *Server, w int) error {
-	size := ulSizes[w]
-	chunkSize := int64(size*100-51) * 10
-	dc := s.Context.NewChunk().UploadHandler(chunkSize)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, io.NopCloser(dc))
+	xulURL, err := s.endpoint(s.Context.uploadURL(), 0)
+	if err != nil {
+		return err
+	}
+	chunkSize := s.Context.uploadSize(w)
+	dc := s.Manager().NewChunk().UploadHandler(chunkSize)
+	req, err := http.NewRequestWithContext(traceContext(ctx), http.MethodPost, xulURL, io.NopCloser(dc))
 	if err != nil {
 		return err
 	}
 	req.ContentLength = chunkSize
-	dbg.Printf("Len=%d, XulURL: %s\n", req.ContentLength, s.URL)
+	s.Context.logger.Debug("upload request", "server", s.ID, "phase", PhaseUpload, "url", xulURL, "size", req.ContentLength)
 	req.Header.Set("Content-Type", "application/octet-stream")
-	resp, err := s.Context.doer.Do(req)
+	resp, err := s.Context.testDoer().Do(req)
 	if err != nil {
 		return err
 	}
@@ -210,28 +310,49 @@ func (s *Server) PingTest(callback func(latency time.Duration)) error {
 
 // PingTestContext executes test to measure latency, observing the given context.
 func (s *Server) PingTestContext(ctx context.Context, callback func(latency time.Duration)) (err error) {
-	start := time.Now()
+	defer s.trackUsage(PhasePing)()
+	end := s.startPhase(PhasePing)
+	defer func() { end(err) }()
+	defer func() { err = wrapError(PhasePing, s.ID, err) }()
+	if s.Context.observed() {
+		userCallback := callback
+		callback = func(latency time.Duration) {
+			s.Context.emit(PingEvent{EventMeta: s.eventMeta(PhasePing), Latency: latency})
+			if userCallback != nil {
+				userCallback(latency)
+			}
+		}
+	}
+	ctx = s.withEventMeta(ctx, PhasePing)
+	start := s.Context.clock.Now()
+	tracer := newConnTracer()
 	var vectorPingResult []int64
 	if s.Context.config.PingMode == TCP {
 		vectorPingResult, err = s.TCPPing(ctx, 10, time.Millisecond*200, callback)
 	} else if s.Context.config.PingMode == ICMP {
 		vectorPingResult, err = s.ICMPPing(ctx, time.Second*4, 10, time.Millisecond*200, callback)
 	} else {
-		vectorPingResult, err = s.HTTPPing(ctx, 10, time.Millisecond*200, callback)
+		vectorPingResult, err = s.HTTPPing(withConnTracer(ctx, tracer), 10, time.Millisecond*200, callback)
+		s.Timing.Ping = tracer.Timing()
+		s.observeTLS(tracer)
 	}
-	if err != nil || len(vectorPingResult) == 0 {
+	// an interrupted ping keeps the latency of the completed echoes
+	if (err != nil && ctx.Err() == nil) || len(vectorPingResult) == 0 {
 		return err
 	}
-	dbg.Printf("Before StandardDeviation: %v\n", vectorPingResult)
+	s.Context.logger.Debug("ping samples", "server", s.ID, "phase", PhasePing, "samples", vectorPingResult)
 	mean, _, std, minLatency, maxLatency := StandardDeviation(vectorPingResult)
-	duration := time.Since(start)
+	duration := s.Context.clock.Now().Sub(start)
 	s.Latency = time.Duration(mean) * time.Nanosecond
 	s.Jitter = time.Duration(std) * time.Nanosecond
 	s.MinLatency = time.Duration(minLatency) * time.Nanosecond
 	s.MaxLatency = time.Duration(maxLatency) * time.Nanosecond
 	s.TestDuration.Ping = &duration
 	s.testDurationTotalCount()
-	return nil
+	if err != nil {
+		s.Partial = true
+	}
+	return err
 }
 
 // TestAll executes ping, download and upload tests one by one
@@ -264,7 +385,7 @@ func (s *Server) TCPPing(
 		pingDst = s.Host
 	}
 	failTimes := 0
-	client, err := transport.NewClient(s.Context.tcpDialer)
+	client, err := transport.NewClient(s.Context.streamDialer())
 	if err != nil {
 		return nil, err
 	}
@@ -273,6 +394,9 @@ func (s *Server) TCPPing(
 		return nil, err
 	}
 	for i := 0; i < echoTimes; i++ {
+		if ctx.Err() != nil {
+			return latencies, ctx.Err()
+		}
 		latency, err := client.PingContext(ctx)
 		if err != nil {
 			failTimes++
@@ -301,9 +425,12 @@ func (s *Server) HTTPPing(
 	if err != nil || len(u.Host) == 0 {
 		return nil, err
 	}
-	u.Path = path.Dir(u.Path)
-	pingDst := u.JoinPath("latency.txt").String()
-	dbg.Printf("Echo: %s\n", pingDst)
+	pingDst, err := s.endpoint(s.Context.latencyURL(), 0)
+	if err != nil {
+		return nil, err
+	}
+	s.Context.logger.Debug("http ping", "server", s.ID, "url", pingDst)
+	s.markHTTP3Bypass()
 	failTimes := 0
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pingDst, nil)
 	if err != nil {
@@ -313,8 +440,13 @@ func (s *Server) HTTPPing(
 	// overall estimation
 	echoTimes++
 	for i := 0; i < echoTimes; i++ {
+		// the pings stop at the data budget once they have a sample
+		if len(latencies) > 0 && s.budgetSpent(PhasePing) {
+			s.Context.logger.Debug("data budget spent", "server", s.ID, "phase", PhasePing, "samples", len(latencies))
+			break
+		}
 		sTime := time.Now()
-		resp, err := s.Context.doer.Do(req)
+		resp, err := s.Context.testDoer().Do(req.WithContext(traceContext(ctx)))
 		endTime := time.Since(sTime)
 		if err != nil {
 			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
@@ -330,7 +462,7 @@ func (s *Server) HTTPPing(
 		if i > 0 {
 			latency := endTime.Nanoseconds()
 			latencies = append(latencies, latency)
-			dbg.Printf("RTT: %d\n", latency)
+			s.Context.logger.Debug("http ping rtt", "server", s.ID, "rtt", time.Duration(latency))
 			if callback != nil {
 				callback(endTime)
 			}
@@ -364,11 +496,16 @@ func (s *Server) ICMPPing(
 	if err != nil || len(u.Host) == 0 {
 		return nil, err
 	}
-	dbg.Printf("Echo: %s\n", strings.Split(u.Host, ":")[0])
+	if s.Context.proxyDialer != nil {
+		// icmp can not be tunnelled through a proxy
+		s.MarkProxyBypass(BypassICMPPing)
+	}
+	s.Context.logger.Debug("icmp ping", "server", s.ID, "host", strings.Split(u.Host, ":")[0])
 	dialContext, err := s.Context.ipDialer.DialContext(ctx, "ip:icmp", strings.Split(u.Host, ":")[0])
 	if err != nil {
 		return nil, err
 	}
+	dialContext = s.Context.countConn(ctx, dialContext)
 	defer dialContext.Close()
 
 	ICMPData := make([]byte, 8+echoOptionDataSize) // header + data
@@ -389,6 +526,9 @@ func (s *Server) ICMPPing(
 
 	failTimes := 0
 	for i := 0; i < echoTimes; i++ {
+		if ctx.Err() != nil {
+			return latencies, ctx.Err()
+		}
 		ICMPData[2] = byte(0)
 		ICMPData[3] = byte(0)
 
@@ -414,7 +554,7 @@ func (s *Server) ICMPPing(
 		}
 		endTime := time.Since(sTime)
 		latencies = append(latencies, endTime.Nanoseconds())
-		dbg.Printf("1RTT: %s\n", endTime)
+		s.Context.logger.Debug("icmp ping rtt", "server", s.ID, "rtt", endTime)
 		if callback != nil {
 			callback(endTime)
 		}
@@ -2,7 +2,6 @@ package speedtest
 
 import (
 	"context"
-	"fmt"
 	"runtime"
 	"testing"
 	"time"
@@ -27,7 +26,7 @@ func TestDownloadTestContext(t *testing.T) {
 		mockRequest,
 	)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 	}
 	value := server.Context.Manager.GetAvgDownloadRate()
 	if value < idealSpeed*(1-delta) || idealSpeed*(1+delta) < value {
@@ -58,7 +57,7 @@ func TestUploadTestContext(t *testing.T) {
 		mockRequest,
 	)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 	}
 	value := server.Context.Manager.GetAvgUploadRate()
 	if value < idealSpeed*(1-delta) || idealSpeed*(1+delta) < value {
@@ -70,7 +69,7 @@ func TestUploadTestContext(t *testing.T) {
 }
 
 func mockRequest(ctx context.Context, s *Server, w int) error {
-	fmt.Sprintln(w)
+	_ = w
 	dc := s.Context.Manager.NewChunk()
 	// (0.1MegaByte * 8bit * nConn * 10loop) / 0.1s = n*80Megabit
 	// sleep has bad deviation on windows
@@ -0,0 +1,363 @@
+package speedtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrDNSResponse = errors.New("unexpected dns-over-https response")
+)
+
+// DNSConfig configures the resolver of a Speedtest client.
+// The resolver is only used by this client, the process-wide
+// net.DefaultResolver is never modified.
+type DNSConfig struct {
+	// Servers are tried in order, each entry is one of
+	//   plain DNS:      "1.1.1.1", "1.1.1.1:53", "[2606:4700:4700::1111]:53"
+	//   DNS-over-TLS:   "tls://1.1.1.1", "tls://dns.quad9.net:853"
+	//   DNS-over-HTTPS: "https://cloudflare-dns.com/dns-query"
+	// If empty, the system name servers are used.
+	Servers []string
+	// Timeout of a single DNS exchange, 5 seconds by default.
+	Timeout time.Duration
+	// TLSConfig is used for DNS-over-TLS and DNS-over-HTTPS servers.
+	TLSConfig *tls.Config
+}
+
+type dnsServer struct {
+	scheme string // "udp", "tls" or "https"
+	addr   string // host:port, or the url of a DNS-over-HTTPS server
+	host   string
+}
+
+func parseDNSServer(server string) (*dnsServer, error) {
+	scheme, address := parseAddr(server)
+	switch scheme {
+	case "", "udp", "dns":
+		scheme = "udp"
+	case "tls", "dot":
+		scheme = "tls"
+	case "https", "http", "doh":
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, err
+		}
+		if scheme == "doh" {
+			u.Scheme = "https"
+		}
+		return &dnsServer{scheme: "https", addr: u.String(), host: u.Hostname()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported dns server scheme: %s", scheme)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+		port = "53"
+		if scheme == "tls" {
+			port = "853"
+		}
+	}
+	return &dnsServer{scheme: scheme, addr: net.JoinHostPort(host, port), host: host}, nil
+}
+
+// resolverDialer dials the name servers of a per-client resolver,
+// optionally bound to the source address or interface of the client.
+type resolverDialer struct {
+	servers   []*dnsServer
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	localAddr func(network string) net.Addr
+	control   func(network, address string, c syscall.RawConn) error
+	doh       *http.Client
+	logger    *slog.Logger
+}
+
+func newResolver(config *DNSConfig, localAddr func(network string) net.Addr, control func(network, address string, c syscall.RawConn) error, logger *slog.Logger) *net.Resolver {
+	if config == nil {
+		config = &DNSConfig{}
+	}
+	rd := &resolverDialer{
+		timeout:   config.Timeout,
+		tlsConfig: config.TLSConfig,
+		localAddr: localAddr,
+		control:   control,
+		logger:    logger,
+	}
+	if rd.timeout == 0 {
+		rd.timeout = 5 * time.Second
+	}
+	if rd.localAddr == nil {
+		rd.localAddr = func(string) net.Addr { return nil }
+	}
+	for _, server := range config.Servers {
+		parsed, err := parseDNSServer(server)
+		if err != nil {
+			rd.logger.Warn("skipping dns server", "dns", server, "err", err)
+			continue
+		}
+		rd.servers = append(rd.servers, parsed)
+	}
+	// the DNS-over-HTTPS server itself is looked up with the system name servers.
+	rd.doh = &http.Client{
+		Timeout: rd.timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         rd.dialer("tcp").DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSClientConfig:     rd.tlsConfig,
+			TLSHandshakeTimeout: rd.timeout,
+		},
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial:     rd.dial,
+	}
+}
+
+func (rd *resolverDialer) dialer(network string) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   rd.timeout,
+		LocalAddr: rd.localAddr(network),
+		Control:   rd.control,
+	}
+}
+
+// dial replaces the connection to the system name server given by the resolver
+// with a connection to the first reachable configured server.
+func (rd *resolverDialer) dial(ctx context.Context, network, systemServer string) (net.Conn, error) {
+	if len(rd.servers) == 0 {
+		return rd.dialer(network).DialContext(ctx, network, systemServer)
+	}
+	var err error
+	for _, server := range rd.servers {
+		var conn net.Conn
+		switch server.scheme {
+		case "tls":
+			conn, err = rd.dialTLS(ctx, server)
+		case "https":
+			conn, err = &dohConn{ctx: ctx, client: rd.doh, url: server.addr}, nil
+		default:
+			conn, err = rd.dialer(network).DialContext(ctx, network, server.addr)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		rd.logger.Debug("dns server unavailable", "dns", server.addr, "err", err)
+	}
+	return nil, err
+}
+
+func (rd *resolverDialer) dialTLS(ctx context.Context, server *dnsServer) (net.Conn, error) {
+	conn, err := rd.dialer("tcp").DialContext(ctx, "tcp", server.addr)
+	if err != nil {
+		return nil, err
+	}
+	var config *tls.Config
+	if rd.tlsConfig != nil {
+		config = rd.tlsConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if len(config.ServerName) == 0 {
+		config.ServerName = server.host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	// tls.Conn is not a net.PacketConn, so the resolver
+	// frames the messages with a two-byte length prefix.
+	return tlsConn, nil
+}
+
+// dohConn carries length-prefixed DNS messages written by the resolver
+// over DNS-over-HTTPS (RFC 8484) requests.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	deadline time.Time
+	wBuf     bytes.Buffer
+	rBuf     bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.wBuf.Write(b)
+	for c.wBuf.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.wBuf.Bytes()[:2]))
+		if c.wBuf.Len() < size+2 {
+			break
+		}
+		c.wBuf.Next(2)
+		answer, err := c.exchange(c.wBuf.Next(size))
+		if err != nil {
+			return 0, err
+		}
+		var prefix [2]byte
+		binary.BigEndian.PutUint16(prefix[:], uint16(len(answer)))
+		c.rBuf.Write(prefix[:])
+		c.rBuf.Write(answer)
+	}
+	return len(b), nil
+}
+
+func (c *dohConn) exchange(query []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrDNSResponse, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.rBuf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.rBuf.Read(b)
+}
+
+func (c *dohConn) Close() error {
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr("")
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(_ time.Time) error {
+	return nil
+}
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+type dohAddr string
+
+func (a dohAddr) Network() string {
+	return "https"
+}
+
+func (a dohAddr) String() string {
+	return string(a)
+}
+
+// ResolveTimes records how long each hostname took to resolve.
+type ResolveTimes struct {
+	mu    sync.Mutex
+	times map[string]time.Duration
+}
+
+func (rt *ResolveTimes) record(host string, duration time.Duration) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.times == nil {
+		rt.times = make(map[string]time.Duration)
+	}
+	// the first resolution is the uncached one, keep it.
+	if _, ok := rt.times[host]; !ok {
+		rt.times[host] = duration
+	}
+}
+
+// Get returns the resolution time of the given hostname.
+func (rt *ResolveTimes) Get(host string) (time.Duration, bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	d, ok := rt.times[host]
+	return d, ok
+}
+
+// All returns a copy of all recorded resolution times, keyed by hostname.
+func (rt *ResolveTimes) All() map[string]time.Duration {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	ret := make(map[string]time.Duration, len(rt.times))
+	for host, d := range rt.times {
+		ret[host] = d
+	}
+	return ret
+}
+
+// dialContext resolves the host with the client resolver, records the
+// resolution time and dials the resolved addresses in order.
+func (s *Speedtest) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := s.dialResolved(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.WrapConn != nil {
+		conn = s.config.WrapConn(conn)
+	}
+	return s.observeConn(ctx, s.countConn(ctx, conn)), nil
+}
+
+func (s *Speedtest) dialResolved(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return s.tcpDialer.DialContext(ctx, network, address)
+	}
+	resolver := s.tcpDialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	start := time.Now()
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	s.resolveTimes.record(host, time.Since(start))
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = s.tcpDialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// ResolveTimes returns the resolution time of each hostname contacted by the client.
+func (s *Speedtest) ResolveTimes() map[string]time.Duration {
+	return s.resolveTimes.All()
+}
@@ -0,0 +1,163 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// dnsAnswer builds a response to the given query, answering
+// every A question with the given address.
+func dnsAnswer(query []byte, ip net.IP) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5 // root label, qtype and qclass
+	if end > len(query) {
+		return nil
+	}
+	qType := binary.BigEndian.Uint16(query[end-4 : end-2])
+	resp := make([]byte, end, end+16)
+	copy(resp, query[:end])
+	resp[2], resp[3] = 0x81, 0x80 // response, recursion desired & available
+	binary.BigEndian.PutUint16(resp[6:8], 0)
+	binary.BigEndian.PutUint16(resp[8:10], 0)
+	binary.BigEndian.PutUint16(resp[10:12], 0) // drop EDNS records
+	if qType == 1 {
+		binary.BigEndian.PutUint16(resp[6:8], 1)
+		resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		resp = append(resp, ip.To4()...)
+	}
+	return resp
+}
+
+func newUDPDNSStandIn(t *testing.T, ip net.IP) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(dnsAnswer(buf[:n], ip), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func newDoTStandIn(t *testing.T, ip net.IP, config *tls.Config) string {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				var prefix [2]byte
+				for {
+					if _, err := io.ReadFull(c, prefix[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+					if _, err := io.ReadFull(c, query); err != nil {
+						return
+					}
+					answer := dnsAnswer(query, ip)
+					binary.BigEndian.PutUint16(prefix[:], uint16(len(answer)))
+					_, _ = c.Write(append(prefix[:], answer...))
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func newDoHStandIn(t *testing.T, ip net.IP) *httptest.Server {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(dnsAnswer(query, ip))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestResolver(t *testing.T) {
+	want := net.IPv4(127, 0, 0, 2)
+	doh := newDoHStandIn(t, want)
+	tlsConfig := doh.Client().Transport.(*http.Transport).TLSClientConfig
+	dot := newDoTStandIn(t, want, doh.TLS)
+
+	// nothing listens on a closed listener address
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	_ = ln.Close()
+
+	testData := map[string][]string{
+		"plain": {newUDPDNSStandIn(t, want)},
+		"dot":   {"tls://" + dot},
+		"doh":   {doh.URL + "/dns-query"},
+		// the error of a failed server does not stop the next one
+		"dot fallback to doh": {"tls://" + closed, doh.URL + "/dns-query"},
+	}
+	for name, servers := range testData {
+		t.Run(name, func(t *testing.T) {
+			resolver := newResolver(&DNSConfig{Servers: servers, TLSConfig: tlsConfig}, nil, nil, discardLogger)
+			ips, err := resolver.LookupIP(context.Background(), "ip4", "speedtest.invalid")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ips) != 1 || !ips[0].Equal(want) {
+				t.Errorf("got unexpected addresses %v, expected %v", ips, want)
+			}
+		})
+	}
+}
+
+func TestResolveTimes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	dnsServer := newUDPDNSStandIn(t, net.IPv4(127, 0, 0, 1))
+	c := New(WithDoer(&http.Client{}), WithUserConfig(&UserConfig{DNS: &DNSConfig{Servers: []string{dnsServer}}}))
+	resp, err := c.doer.Get("http://speedtest.invalid:" + u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if _, ok := c.ResolveTimes()["speedtest.invalid"]; !ok {
+		t.Errorf("resolution time is not recorded: %v", c.ResolveTimes())
+	}
+	if net.DefaultResolver.Dial != nil {
+		t.Error("process-wide resolver is modified")
+	}
+}
@@ -0,0 +1,220 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest/transport"
+)
+
+var (
+	ErrTransferFailed = errors.New("too many failed requests, the rate is not available")
+	ErrUnknownPhase   = errors.New("unknown phase")
+)
+
+// ServerInfo identifies the server of a Result.
+type ServerInfo struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Sponsor  string  `json:"sponsor"`
+	Country  string  `json:"country"`
+	Host     string  `json:"host"`
+	URL      string  `json:"url"`
+	Lat      string  `json:"lat"`
+	Lon      string  `json:"lon"`
+	Distance float64 `json:"distance"`
+}
+
+// Result is the outcome of the tests against a server. It is a value: the
+// later tests of the server do not change it.
+type Result struct {
+	Server        ServerInfo           `json:"server"`
+	Timestamp     time.Time            `json:"timestamp"`
+	Latency       time.Duration        `json:"latency"`
+	MaxLatency    time.Duration        `json:"max_latency"`
+	MinLatency    time.Duration        `json:"min_latency"`
+	Jitter        time.Duration        `json:"jitter"`
+	DLSpeed       ByteRate             `json:"dl_speed"`
+	ULSpeed       ByteRate             `json:"ul_speed"`
+	DLStats       TransferStats        `json:"dl_stats"`
+	ULStats       TransferStats        `json:"ul_stats"`
+	Bidirectional *BidirectionalResult `json:"bidirectional,omitempty"`
+	TestDuration  TestDuration         `json:"test_duration"`
+	Timing        TestTiming           `json:"timing"`
+	TLS           *TLSInfo             `json:"tls,omitempty"`
+	DataUsage     map[Phase]int64      `json:"data_usage,omitempty"`
+	PacketLoss    transport.PLoss      `json:"packet_loss"`
+	ProxyBypass   []string             `json:"proxy_bypass,omitempty"`
+	Errors        map[Phase]string     `json:"errors,omitempty"`  // of the phases that failed
+	Partial       bool                 `json:"partial,omitempty"` // a phase was interrupted by the context
+}
+
+// Info returns the identity of the server.
+func (s *Server) Info() ServerInfo {
+	return ServerInfo{
+		ID:       s.ID,
+		Name:     s.Name,
+		Sponsor:  s.Sponsor,
+		Country:  s.Country,
+		Host:     s.Host,
+		URL:      s.URL,
+		Lat:      s.Lat,
+		Lon:      s.Lon,
+		Distance: s.Distance,
+	}
+}
+
+// Result returns a snapshot of the results held in the fields of the server.
+func (s *Server) Result() Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result()
+}
+
+func (s *Server) result() Result {
+	return Result{
+		Server:        s.Info(),
+		Timestamp:     time.Now(),
+		Latency:       s.Latency,
+		MaxLatency:    s.MaxLatency,
+		MinLatency:    s.MinLatency,
+		Jitter:        s.Jitter,
+		DLSpeed:       s.DLSpeed,
+		ULSpeed:       s.ULSpeed,
+		DLStats:       s.DLStats,
+		ULStats:       s.ULStats,
+		Bidirectional: s.Bidirectional,
+		TestDuration:  s.TestDuration,
+		Timing:        s.Timing,
+		TLS:           s.TLS,
+		DataUsage:     maps.Clone(s.DataUsage),
+		PacketLoss:    s.PacketLoss,
+		ProxyBypass:   slices.Clone(s.ProxyBypass),
+		Partial:       s.Partial,
+	}
+}
+
+// Run executes the given phases against the server one by one, ping,
+// download and upload if none is given, and returns their Result. The packet
+// loss phase runs an analyzer of the client, see SetPacketLossOptions, for
+// its sampling duration. A failed
+// phase does not stop the others, its error is kept in Result.Errors and
+// joined in the returned error. The tests run on a private copy of the
+// server, so a Result never sees the fields of another run; the fields of
+// the server are updated afterwards for compatibility. Unless the server has
+// a manager of its own, see SetManager, the copy tests with a manager given
+// by Speedtest.NewManager: the runs never mix their test data, and the
+// callbacks of the client manager are not called. The runs of a server with
+// its own manager share it, so they must not overlap.
+func (s *Server) Run(ctx context.Context, phases ...Phase) (Result, error) {
+	if len(phases) == 0 {
+		phases = []Phase{PhasePing, PhaseDownload, PhaseUpload}
+	}
+	s.mu.Lock()
+	run := s.testCopy()
+	s.mu.Unlock()
+	// the runs do not share the test data of the client, even if they run at the same time
+	if run.manager == nil {
+		run.SetManager(s.Context.NewManager())
+	}
+
+	start := time.Now()
+	errs := map[Phase]error{}
+	for _, phase := range phases {
+		if ctx.Err() != nil {
+			errs[phase] = wrapError(phase, run.ID, ctx.Err())
+			continue
+		}
+		var err error
+		switch phase {
+		case PhasePing:
+			err = run.PingTestContext(ctx, nil)
+		case PhaseDownload:
+			err = run.DownloadTestContext(ctx)
+		case PhaseUpload:
+			err = run.UploadTestContext(ctx)
+		case PhasePacketLoss:
+			err = run.packetLossTest(ctx)
+		default:
+			err = fmt.Errorf("%w: %s", ErrUnknownPhase, phase)
+		}
+		if err != nil {
+			errs[phase] = wrapError(phase, run.ID, err)
+		}
+	}
+
+	result := run.result()
+	result.Timestamp = start
+	var joined []error
+	for _, phase := range phases {
+		if err, ok := errs[phase]; ok {
+			if result.Errors == nil {
+				result.Errors = map[Phase]string{}
+			}
+			result.Errors[phase] = errors.Unwrap(err).Error()
+			joined = append(joined, err)
+		}
+	}
+	s.update(run, phases)
+	return result, errors.Join(joined...)
+}
+
+// testCopy returns a server with the identity, client and manager of s and no results.
+func (s *Server) testCopy() *Server {
+	return &Server{
+		URL:       s.URL,
+		Lat:       s.Lat,
+		Lon:       s.Lon,
+		Name:      s.Name,
+		Country:   s.Country,
+		Sponsor:   s.Sponsor,
+		ID:        s.ID,
+		Host:      s.Host,
+		Distance:  s.Distance,
+		Context:   s.Context,
+		manager:   s.manager,
+		wireBytes: s.wireBytes,
+	}
+}
+
+// update copies the results of the phases run on the private copy into the server fields.
+func (s *Server) update(run *Server, phases []Phase) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, phase := range phases {
+		switch phase {
+		case PhasePing:
+			s.Latency, s.Jitter = run.Latency, run.Jitter
+			s.MinLatency, s.MaxLatency = run.MinLatency, run.MaxLatency
+			s.TestDuration.Ping, s.Timing.Ping = run.TestDuration.Ping, run.Timing.Ping
+		case PhaseDownload:
+			s.DLSpeed, s.DLStats = run.DLSpeed, run.DLStats
+			s.TestDuration.Download, s.Timing.Download = run.TestDuration.Download, run.Timing.Download
+		case PhaseUpload:
+			s.ULSpeed, s.ULStats = run.ULSpeed, run.ULStats
+			s.TestDuration.Upload, s.Timing.Upload = run.TestDuration.Upload, run.Timing.Upload
+		case PhasePacketLoss:
+			s.PacketLoss = run.PacketLoss
+		}
+	}
+	for _, m := range run.ProxyBypass {
+		if !slices.Contains(s.ProxyBypass, m) {
+			s.ProxyBypass = append(s.ProxyBypass, m)
+		}
+	}
+	if run.TLS != nil {
+		s.TLS = run.TLS
+	}
+	s.Partial = run.Partial // of the last run only
+	for phase, n := range run.DataUsage {
+		if s.DataUsage == nil {
+			s.DataUsage = map[Phase]int64{}
+		}
+		s.DataUsage[phase] += n
+	}
+	s.testDurationTotalCount()
+}
@@ -0,0 +1,137 @@
+package speedtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	ts := newSpeedtestStandIn(256 * 1024)
+	defer ts.Close()
+
+	c := New()
+	c.SetCaptureTime(time.Second)
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := server.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Server.ID != "Custom" || first.Server.URL != server.URL || first.Timestamp.IsZero() {
+		t.Errorf("got unexpected identity %+v at %v", first.Server, first.Timestamp)
+	}
+	if first.Latency <= 0 || first.DLSpeed <= 0 || first.ULSpeed <= 0 || len(first.Errors) != 0 {
+		t.Errorf("got unexpected result %+v", first)
+	}
+	// the fields are kept for compatibility
+	if server.DLSpeed != first.DLSpeed || server.Latency != first.Latency || *server.TestDuration.Total <= 0 {
+		t.Errorf("the server fields are not updated, download: %v, latency: %v", server.DLSpeed, server.Latency)
+	}
+
+	second, err := server.Run(context.Background(), PhaseDownload, "jitter")
+	if !errors.Is(err, ErrUnknownPhase) || len(second.Errors) != 1 || len(second.Errors["jitter"]) == 0 {
+		t.Errorf("got unexpected errors %v, %v", err, second.Errors)
+	}
+	if second.Latency != 0 || second.ULSpeed != 0 || second.DLSpeed <= 0 {
+		t.Errorf("got results of phases not run %+v", second)
+	}
+	if server.DLSpeed != second.DLSpeed || server.ULSpeed != first.ULSpeed {
+		t.Errorf("got unexpected fields, download: %v, upload: %v", server.DLSpeed, server.ULSpeed)
+	}
+	if first.DLSpeed == second.DLSpeed && *first.TestDuration.Download == *second.TestDuration.Download {
+		t.Error("the first result is changed by the second run")
+	}
+
+	// a complete run clears the mark of an interrupted one
+	server.Partial = true
+	if _, err = server.Run(context.Background(), PhasePing); err != nil {
+		t.Fatal(err)
+	}
+	if server.Partial {
+		t.Error("the server is still marked partial")
+	}
+}
+
+func TestRunIsolation(t *testing.T) {
+	ts := newSpeedtestStandIn(256 * 1024)
+	defer ts.Close()
+
+	c := New()
+	c.SetCaptureTime(time.Second)
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two runs of the same server at the same time do not mix their data
+	results := make([]Result, 2)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = server.Run(context.Background(), PhaseDownload)
+		}()
+	}
+	wg.Wait()
+	for i, result := range results {
+		if errs[i] != nil || result.DLSpeed <= 0 || result.DataUsage[PhaseDownload] <= 0 {
+			t.Errorf("got unexpected result %+v, %v", result, errs[i])
+		}
+	}
+	if n := c.Manager.GetTotalDownload(); n != 0 {
+		t.Errorf("the runs downloaded %d bytes on the client manager", n)
+	}
+}
+
+func TestRunPacketLoss(t *testing.T) {
+	c := New()
+	c.SetPacketLossOptions(PacketLossAnalyzerOptions{
+		SamplingDuration:       time.Second,
+		RemoteSamplingInterval: 100 * time.Millisecond,
+		PacketSendingInterval:  10 * time.Millisecond,
+	})
+	server := &Server{ID: "loss", Host: newPacketLossStandIn(t), Context: c}
+	result, err := server.Run(context.Background(), PhasePacketLoss)
+	if err != nil || len(result.Errors) != 0 {
+		t.Fatalf("got unexpected errors %v, %v", err, result.Errors)
+	}
+	if result.PacketLoss.Sent <= 0 || server.PacketLoss != result.PacketLoss {
+		t.Errorf("got unexpected packet loss %v, the server has %v", result.PacketLoss, server.PacketLoss)
+	}
+
+	// the measurements of a run that bypassed the proxy are kept by the server
+	run := server.testCopy()
+	run.MarkProxyBypass(BypassPacketLoss)
+	server.update(run, []Phase{PhasePacketLoss})
+	server.update(run, []Phase{PhasePacketLoss})
+	if len(server.ProxyBypass) != 1 || server.ProxyBypass[0] != BypassPacketLoss {
+		t.Errorf("got unexpected proxy bypass %v", server.ProxyBypass)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	ts := newSpeedtestStandIn(1024)
+	ts.Close() // nothing listens anymore
+
+	server, err := New().CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := server.Run(context.Background(), PhasePing)
+	if err == nil || len(result.Errors[PhasePing]) == 0 {
+		t.Errorf("expected a ping error, got %v, %v", err, result.Errors)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err = server.Run(ctx, PhaseDownload, PhaseUpload)
+	if !errors.Is(err, context.Canceled) || len(result.Errors) != 2 {
+		t.Errorf("expected the canceled phases, got %v, %v", err, result.Errors)
+	}
+}
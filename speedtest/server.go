@@ -32,30 +32,85 @@ const (
 )
 
 var (
-	ErrServerNotFound = errors.New("no server available or found")
+	ErrServerNotFound  = errors.New("no server available or found")
+	ErrPayloadDecoding = errors.New("response payload decoding not implemented")
 )
 
 // Server information
 type Server struct {
-	URL          string          `xml:"url,attr" json:"url"`
-	Lat          string          `xml:"lat,attr" json:"lat"`
-	Lon          string          `xml:"lon,attr" json:"lon"`
-	Name         string          `xml:"name,attr" json:"name"`
-	Country      string          `xml:"country,attr" json:"country"`
-	Sponsor      string          `xml:"sponsor,attr" json:"sponsor"`
-	ID           string          `xml:"id,attr" json:"id"`
-	Host         string          `xml:"host,attr" json:"host"`
-	Distance     float64         `json:"distance"`
-	Latency      time.Duration   `json:"latency"`
-	MaxLatency   time.Duration   `json:"max_latency"`
-	MinLatency   time.Duration   `json:"min_latency"`
-	Jitter       time.Duration   `json:"jitter"`
-	DLSpeed      ByteRate        `json:"dl_speed"`
-	ULSpeed      ByteRate        `json:"ul_speed"`
-	TestDuration TestDuration    `json:"test_duration"`
-	PacketLoss   transport.PLoss `json:"packet_loss"`
+	URL           string               `xml:"url,attr" json:"url"`
+	Lat           string               `xml:"lat,attr" json:"lat"`
+	Lon           string               `xml:"lon,attr" json:"lon"`
+	Name          string               `xml:"name,attr" json:"name"`
+	Country       string               `xml:"country,attr" json:"country"`
+	Sponsor       string               `xml:"sponsor,attr" json:"sponsor"`
+	ID            string               `xml:"id,attr" json:"id"`
+	Host          string               `xml:"host,attr" json:"host"`
+	Distance      float64              `json:"distance"`
+	Latency       time.Duration        `json:"latency"`
+	MaxLatency    time.Duration        `json:"max_latency"`
+	MinLatency    time.Duration        `json:"min_latency"`
+	Jitter        time.Duration        `json:"jitter"`
+	DLSpeed       ByteRate             `json:"dl_speed"`
+	ULSpeed       ByteRate             `json:"ul_speed"`
+	DLStats       TransferStats        `json:"dl_stats"`
+	ULStats       TransferStats        `json:"ul_stats"`
+	Bidirectional *BidirectionalResult `json:"bidirectional,omitempty"`
+	TestDuration  TestDuration         `json:"test_duration"`
+	Timing        TestTiming           `json:"timing"`
+	TLS           *TLSInfo             `json:"tls,omitempty"`
+	DataUsage     map[Phase]int64      `json:"data_usage,omitempty"` // bytes moved on the sockets by each phase
+	PacketLoss    transport.PLoss      `json:"packet_loss"`
+	ProxyBypass   []string             `json:"proxy_bypass,omitempty"` // measurements that reached the server without the proxy
+	Runs          []Result             `json:"runs,omitempty"`         // results of each iteration of a repeated test, see RecordRun
+	Summary       *RunSummary          `json:"summary,omitempty"`      // aggregate of the Runs
+	Partial       bool                 `json:"partial,omitempty"`      // a test was interrupted by its context, the results are incomplete
 
 	Context *Speedtest `json:"-"`
+
+	manager   Manager // of the tests, the client manager if nil, see SetManager
+	wireBytes *int64  // read and written on the connections of the tests, the client counter if nil
+
+	mu sync.Mutex // guards the result fields written back by Run
+}
+
+// Manager returns the manager collecting the data of the tests of the server.
+func (s *Server) Manager() Manager {
+	if s.manager != nil {
+		return s.manager
+	}
+	return s.Context.Manager
+}
+
+// SetManager makes the server test with its own manager and count its own data
+// usage, so that it can be tested at the same time as the other servers of the
+// client, see Speedtest.NewManager. nil restores the manager of the client.
+func (s *Server) SetManager(manager Manager) {
+	s.manager = manager
+	s.wireBytes = nil
+	if manager != nil {
+		s.wireBytes = new(int64)
+	}
+}
+
+// Measurements that can not be tunnelled through the configured proxy.
+const (
+	BypassICMPPing   = "icmp_ping"
+	BypassPacketLoss = "packet_loss"
+	BypassHTTP3      = "http3" // the http ping, download and upload requests over QUIC
+)
+
+// TLSInfo describes the secured connection to the server.
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+}
+
+// observeTLS keeps the TLS parameters seen by the tracer of the last test.
+func (s *Server) observeTLS(ct *connTracer) {
+	if info := ct.TLS(); info != nil {
+		s.TLS = info
+	}
 }
 
 type TestDuration struct {
@@ -67,18 +122,25 @@ type TestDuration struct {
 
 // CustomServer use defaultClient, given a URL string, return a new Server object, with as much
 // filled in as we can
+//
+// Deprecated: the default client is shared by the whole process, use the
+// method of a client created with New instead.
 func CustomServer(host string) (*Server, error) {
 	return defaultClient.CustomServer(host)
 }
 
 // CustomServer given a URL string, return a new Server object, with as much
-// filled in as we can
+// filled in as we can. The path is replaced with the one of the Ookla servers
+// unless a url template is configured.
 func (s *Speedtest) CustomServer(host string) (*Server, error) {
 	u, err := url.Parse(host)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(PhaseDiscovery, "Custom", err)
+	}
+	// the url templates are resolved against the given path
+	if !s.customEndpoints() {
+		u.Path = "/speedtest/upload.php"
 	}
-	u.Path = "/speedtest/upload.php"
 	parseHost := u.String()
 	return &Server{
 		ID:      "Custom",
@@ -155,12 +217,16 @@ func (s *Speedtest) FetchServerByID(serverID string) (*Server, error) {
 }
 
 // FetchServerByID retrieves a server by given serverID.
+//
+// Deprecated: the default client is shared by the whole process, use the
+// method of a client created with New instead.
 func FetchServerByID(serverID string) (*Server, error) {
 	return defaultClient.FetchServerByID(serverID)
 }
 
 // FetchServerByIDContext retrieves a server by given serverID, observing the given context.
-func (s *Speedtest) FetchServerByIDContext(ctx context.Context, serverID string) (*Server, error) {
+func (s *Speedtest) FetchServerByIDContext(ctx context.Context, serverID string) (_ *Server, err error) {
+	defer func() { err = wrapError(PhaseDiscovery, serverID, err) }()
 	u, err := url.Parse(speedTestServersAdvanced)
 	if err != nil {
 		return nil, err
@@ -205,12 +271,16 @@ func (s *Speedtest) FetchServers() (Servers, error) {
 }
 
 // FetchServers retrieves a list of available servers
+//
+// Deprecated: the default client is shared by the whole process, use the
+// method of a client created with New instead.
 func FetchServers() (Servers, error) {
 	return defaultClient.FetchServers()
 }
 
 // FetchServerListContext retrieves a list of available servers, observing the given context.
-func (s *Speedtest) FetchServerListContext(ctx context.Context) (Servers, error) {
+func (s *Speedtest) FetchServerListContext(ctx context.Context) (_ Servers, err error) {
+	defer func() { err = wrapError(PhaseDiscovery, "", err) }()
 	u, err := url.Parse(speedTestServersUrl)
 	if err != nil {
 		return Servers{}, err
@@ -224,7 +294,7 @@ func (s *Speedtest) FetchServerListContext(ctx context.Context) (Servers, error)
 		query.Set("lon", strconv.FormatFloat(s.config.Location.Lon, 'f', -1, 64))
 	}
 	u.RawQuery = query.Encode()
-	dbg.Printf("Retrieving servers: %s\n", u.String())
+	s.logger.Debug("retrieving servers", "url", u.String())
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return Servers{}, err
@@ -276,10 +346,10 @@ func (s *Speedtest) FetchServerListContext(ctx context.Context) (Servers, error)
 
 		servers = list.Servers
 	default:
-		return servers, errors.New("response payload decoding not implemented")
+		return servers, ErrPayloadDecoding
 	}
 
-	dbg.Printf("Servers Num: %d\n", len(servers))
+	s.logger.Debug("servers retrieved", "count", len(servers))
 	// set doer of server
 	for _, server := range servers {
 		server.Context = s
@@ -288,7 +358,7 @@ func (s *Speedtest) FetchServerListContext(ctx context.Context) (Servers, error)
 	// ping once
 	var wg sync.WaitGroup
 	pCtx, fc := context.WithTimeout(context.Background(), time.Second*4)
-	dbg.Println("Echo each server...")
+	s.logger.Debug("echo each server")
 	for _, server := range servers {
 		wg.Add(1)
 		go func(gs *Server) {
@@ -336,6 +406,9 @@ func (s *Speedtest) FetchServerListContext(ctx context.Context) (Servers, error)
 }
 
 // FetchServerListContext retrieves a list of available servers, observing the given context.
+//
+// Deprecated: the default client is shared by the whole process, use the
+// method of a client created with New instead.
 func FetchServerListContext(ctx context.Context) (Servers, error) {
 	return defaultClient.FetchServerListContext(ctx)
 }
@@ -359,7 +432,7 @@ func (servers Servers) FindServer(serverID []int) (Servers, error) {
 	retServer := Servers{}
 
 	if len(servers) <= 0 {
-		return retServer, ErrServerNotFound
+		return retServer, wrapError(PhaseDiscovery, "", ErrServerNotFound)
 	}
 
 	for _, sid := range serverID {
@@ -424,6 +497,19 @@ func (s *Server) CheckResultValid() bool {
 	return !(s.DLSpeed*100 < s.ULSpeed) || !(s.DLSpeed > s.ULSpeed*100)
 }
 
+// MarkProxyBypass records that the given measurement reached the server
+// without the proxy, it is safe to call while the server is tested.
+func (s *Server) MarkProxyBypass(measurement string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.ProxyBypass {
+		if m == measurement {
+			return
+		}
+	}
+	s.ProxyBypass = append(s.ProxyBypass, measurement)
+}
+
 func (s *Server) testDurationTotalCount() {
 	total := s.getNotNullValue(s.TestDuration.Ping) +
 		s.getNotNullValue(s.TestDuration.Download) +
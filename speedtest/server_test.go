@@ -4,6 +4,7 @@ import (
 	"errors"
 	"math"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 )
@@ -18,7 +19,7 @@ func TestFetchServerList(t *testing.T) {
 	}
 	servers, err := client.FetchServers()
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 	}
 	if len(servers) == 0 {
 		t.Errorf("Failed to fetch server list.")
@@ -97,7 +98,7 @@ func TestFindServer(t *testing.T) {
 	var serverID []int
 	s, err := servers.FindServer(serverID)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 	}
 	if len(s) != 1 {
 		t.Errorf("unexpected server length. got: %v, expected: 1", len(s))
@@ -109,7 +110,7 @@ func TestFindServer(t *testing.T) {
 	serverID = []int{2}
 	s, err = servers.FindServer(serverID)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 	}
 	if len(s) != 1 {
 		t.Errorf("unexpected server length. got: %v, expected: 1", len(s))
@@ -121,7 +122,7 @@ func TestFindServer(t *testing.T) {
 	serverID = []int{3, 1}
 	s, err = servers.FindServer(serverID)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 	}
 	if len(s) != 2 {
 		t.Errorf("unexpected server length. got: %v, expected: 2", len(s))
@@ -138,7 +139,7 @@ func TestCustomServer(t *testing.T) {
 	// Good server
 	got, err := CustomServer("https://example.com/upload.php")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 	}
 	if got == nil {
 		t.Error("empty server")
@@ -202,3 +203,21 @@ func TestTotalDurationCount(t *testing.T) {
 		t.Error("addition in testDurationTotalCount didn't work")
 	}
 }
+
+func TestMarkProxyBypass(t *testing.T) {
+	server := &Server{}
+	// the http3 tests and the pings in the background mark the server at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.MarkProxyBypass(BypassHTTP3)
+			_ = server.Result()
+		}()
+	}
+	wg.Wait()
+	if len(server.ProxyBypass) != 1 || server.ProxyBypass[0] != BypassHTTP3 {
+		t.Errorf("got proxy bypass %v, want %v", server.ProxyBypass, []string{BypassHTTP3})
+	}
+}
@@ -2,14 +2,22 @@ package speedtest
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/showwin/speedtest-go/speedtest/transport"
 )
 
 var (
@@ -30,10 +38,22 @@ type Speedtest struct {
 	User *User
 	Manager
 
-	doer      *http.Client
-	config    *UserConfig
-	tcpDialer *net.Dialer
-	ipDialer  *net.Dialer
+	doer         *http.Client
+	config       *UserConfig
+	tcpDialer    *net.Dialer
+	ipDialer     *net.Dialer
+	proxyDialer  *transport.ProxyDialer // tunnels the tcp ping, nil if no proxy is set
+	resolveTimes *ResolveTimes
+	h3           *http.Client // carries the test requests over QUIC, nil unless UserConfig.HTTP3 is set
+	quicDialer   *quicDialer
+	wireBytes    int64 // read and written on the sockets, see trackUsage
+	logger       *slog.Logger
+	loggerSet    bool     // by WithLogger, UserConfig.Debug does not replace it
+	clock        Clock    // of the rate capture and the test durations, see WithClock
+	unit         UnitType // of FormatRate
+	locations    *locationTable
+	observers    observers
+	lossOptions  PacketLossAnalyzerOptions // of NewPacketLossAnalyzer
 }
 
 type UserConfig struct {
@@ -41,11 +61,34 @@ type UserConfig struct {
 	UserAgent     string
 	Proxy         string
 	Source        string
+	Interface     string // bind all sockets to the named network interface
 	DnsBindSource bool
+	DNS           *DNSConfig // per-client resolver, the system resolver is used if nil
+	HTTP3         bool       // run download, upload and http ping over HTTP/3 (QUIC), http urls are requested over https
 	DialerControl func(network, address string, c syscall.RawConn) error
+	WrapConn      func(net.Conn) net.Conn // wraps the tcp connections once dialed, e.g. with netem.Link.Conn
 	Debug         bool
 	PingMode      Proto
 
+	// TLS of the http transports, TLSConfig is cloned and the options below are applied on top of it.
+	TLSConfig          *tls.Config
+	CAFile             string // PEM bundle trusted in addition to the system roots
+	ClientCertFile     string
+	ClientKeyFile      string // may be left empty if the key is in ClientCertFile
+	TLSMinVersion      string // 1.0, 1.1, 1.2 or 1.3
+	InsecureSkipVerify bool
+
+	MaxData int64 // limit the bytes of a run with a DataBudget, zero means no limit
+
+	// Transfer sizes and endpoints, the Ookla defaults are used if left empty.
+	// The URL templates are resolved against the server URL, {size} is replaced
+	// with DownloadSize in DownloadURL.
+	DownloadSize int   // edge of the random image, or the {size} of DownloadURL
+	UploadSize   int64 // bytes of an upload request body
+	DownloadURL  string
+	UploadURL    string
+	LatencyURL   string
+
 	SavingMode     bool
 	MaxConnections int
 
@@ -64,33 +107,49 @@ func parseAddr(addr string) (string, string) {
 	return "", addr // ignore address network prefix
 }
 
-func (s *Speedtest) NewUserConfig(uc *UserConfig) {
-	if uc.Debug {
-		dbg.Enable()
+// NewUserConfig applies the user config to the client. The client refuses to
+// dial if the config is invalid, e.g. the interface cannot be bound, the tls
+// options cannot be loaded or a url template does not parse, so it never tests
+// over another route, without the requested certificates or another endpoint.
+func (s *Speedtest) NewUserConfig(uc *UserConfig) error {
+	var errs []error
+	if uc.Debug && !s.loggerSet {
+		s.setLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
 	}
 
 	if uc.SavingMode {
 		uc.MaxConnections = 1 // Set the number of concurrent connections to 1
 	}
 	s.SetNThread(uc.MaxConnections)
+	if uc.MaxData > 0 {
+		s.SetDataBudget(NewDataBudget(uc.MaxData))
+	}
+	for _, template := range []string{uc.DownloadURL, uc.UploadURL, uc.LatencyURL} {
+		if err := checkURLTemplate(template); err != nil {
+			errs = append(errs, fmt.Errorf("url template %q: %w", template, err))
+		}
+	}
 
 	if len(uc.CityFlag) > 0 {
 		var err error
-		uc.Location, err = GetLocation(uc.CityFlag)
+		uc.Location, err = s.GetLocation(uc.CityFlag)
 		if err != nil {
-			dbg.Printf("Warning: skipping command line arguments: --city. err: %v\n", err.Error())
+			s.logger.Warn("skipping the city", "city", uc.CityFlag, "err", err)
 		}
 	}
 	if len(uc.LocationFlag) > 0 {
 		var err error
-		uc.Location, err = ParseLocation(uc.CityFlag, uc.LocationFlag)
+		uc.Location, err = s.ParseLocation(uc.CityFlag, uc.LocationFlag)
 		if err != nil {
-			dbg.Printf("Warning: skipping command line arguments: --location. err: %v\n", err.Error())
+			s.logger.Warn("skipping the location", "location", uc.LocationFlag, "err", err)
 		}
 	}
 
 	var tcpSource net.Addr // If nil, a local address is automatically chosen.
 	var icmpSource net.Addr
+	var resolver *net.Resolver // If nil, the default resolver is used.
+	var dnsLocalAddr func(network string) net.Addr
+	var control = uc.DialerControl
 	var proxy = http.ProxyFromEnvironment
 	s.config = uc
 	if len(s.config.UserAgent) == 0 {
@@ -102,61 +161,99 @@ func (s *Speedtest) NewUserConfig(uc *UserConfig) {
 		if err == nil {
 			tcpSource = addr0
 		} else {
-			dbg.Printf("Warning: skipping parse the source address. err: %s\n", err.Error())
+			s.logger.Warn("skipping parse the source address", "source", uc.Source, "err", err)
 		}
 		addr1, err := net.ResolveIPAddr("ip", address) // dynamic tcp port
 		if err == nil {
 			icmpSource = addr1
 		} else {
-			dbg.Printf("Warning: skipping parse the source address. err: %s\n", err.Error())
+			s.logger.Warn("skipping parse the source address", "source", uc.Source, "err", err)
 		}
 		if uc.DnsBindSource {
-			net.DefaultResolver.Dial = func(ctx context.Context, network, dnsServer string) (net.Conn, error) {
-				dialer := &net.Dialer{
-					Timeout: 5 * time.Second,
-					LocalAddr: func(network string) net.Addr {
-						switch network {
-						case "udp", "udp4", "udp6":
-							return &net.UDPAddr{IP: net.ParseIP(address)}
-						case "tcp", "tcp4", "tcp6":
-							return &net.TCPAddr{IP: net.ParseIP(address)}
-						default:
-							return nil
-						}
-					}(network),
+			dnsLocalAddr = func(network string) net.Addr {
+				switch network {
+				case "udp", "udp4", "udp6":
+					return &net.UDPAddr{IP: net.ParseIP(address)}
+				case "tcp", "tcp4", "tcp6":
+					return &net.TCPAddr{IP: net.ParseIP(address)}
+				default:
+					return nil
 				}
-				return dialer.DialContext(ctx, network, dnsServer)
 			}
 		}
 	}
 
-	if len(uc.Proxy) > 0 {
-		if parse, err := url.Parse(uc.Proxy); err != nil {
-			dbg.Printf("Warning: skipping parse the proxy host. err: %s\n", err.Error())
+	if len(uc.Interface) > 0 {
+		binding, err := newInterfaceBinding(uc.Interface)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("interface %s: %w", uc.Interface, err))
 		} else {
-			proxy = func(_ *http.Request) (*url.URL, error) {
-				return parse, err
+			s.logger.Debug("interface bound", "interface", uc.Interface, "address", binding.ip)
+			control = chainControl(binding.control, uc.DialerControl)
+			if addr := binding.tcpAddr(); addr != nil {
+				tcpSource = addr
+			}
+			if addr := binding.ipAddr(); addr != nil {
+				icmpSource = addr
 			}
+			dnsLocalAddr = binding.localAddr
 		}
 	}
 
+	tlsConfig, err := uc.tlsConfig()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("tls options: %w", err))
+	}
+
+	// the sockets are refused rather than dialed without the requested options
+	if err := errors.Join(errs...); err != nil {
+		control = refuseControl(err)
+	}
+
+	// the resolver belongs to this client only, net.DefaultResolver is left untouched.
+	if uc.DNS != nil || dnsLocalAddr != nil {
+		resolver = newResolver(uc.DNS, dnsLocalAddr, control, s.logger)
+	}
+
 	s.tcpDialer = &net.Dialer{
 		LocalAddr: tcpSource,
 		Timeout:   30 * time.Second,
 		KeepAlive: 30 * time.Second,
-		Control:   uc.DialerControl,
+		Control:   control,
+		Resolver:  resolver,
+	}
+
+	s.proxyDialer = nil
+	if len(uc.Proxy) > 0 {
+		if parse, err := url.Parse(uc.Proxy); err != nil {
+			s.logger.Warn("skipping parse the proxy host", "proxy", uc.Proxy, "err", err)
+		} else {
+			proxy = func(_ *http.Request) (*url.URL, error) {
+				return parse, err
+			}
+			s.proxyDialer, err = transport.NewProxyDialer(parse, dialerFunc(s.dialContext), nil)
+			if err != nil {
+				s.logger.Warn("tcp ping will bypass the proxy", "proxy", uc.Proxy, "err", err)
+			}
+		}
 	}
 
 	s.ipDialer = &net.Dialer{
 		LocalAddr: icmpSource,
 		Timeout:   30 * time.Second,
 		KeepAlive: 30 * time.Second,
-		Control:   uc.DialerControl,
+		Control:   control,
+		Resolver:  resolver,
+	}
+
+	if tlsConfig != nil && tlsConfig.InsecureSkipVerify {
+		s.logger.Warn("tls certificates are not verified")
 	}
 
 	s.config.T = &http.Transport{
 		Proxy:                 proxy,
-		DialContext:           s.tcpDialer.DialContext,
+		DialContext:           s.dialContext,
+		TLSClientConfig:       tlsConfig,
 		ForceAttemptHTTP2:     true,
 		MaxIdleConns:          100,
 		IdleConnTimeout:       90 * time.Second,
@@ -164,7 +261,44 @@ func (s *Speedtest) NewUserConfig(uc *UserConfig) {
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 
+	if s.quicDialer != nil {
+		_ = s.quicDialer.Close()
+	}
+	s.h3, s.quicDialer = nil, nil
+	if uc.HTTP3 {
+		if s.proxyDialer != nil {
+			s.logger.Warn("http3 requests will bypass the proxy", "proxy", uc.Proxy)
+		}
+		// the QUIC socket is shared by the servers, its datagrams count into the client usage
+		s.quicDialer = &quicDialer{control: control, resolver: resolver, times: s.resolveTimes, count: func(n int64) {
+			atomic.AddInt64(&s.wireBytes, n)
+		}, budget: s.GetDataBudget}
+		if addr, ok := tcpSource.(*net.TCPAddr); ok {
+			s.quicDialer.localAddr = &net.UDPAddr{IP: addr.IP, Zone: addr.Zone}
+		}
+		s.h3 = &http.Client{Transport: &http3RoundTripper{
+			s: s,
+			t: &http3.Transport{TLSClientConfig: tlsConfig, Dial: s.quicDialer.Dial},
+		}}
+	}
+
 	s.doer.Transport = s
+	return errors.Join(errs...)
+}
+
+// dialerFunc adapts a dial function to the transport.Dialer interface.
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// streamDialer returns the dialer of the tcp control protocol, tunnelled through the proxy if any.
+func (s *Speedtest) streamDialer() transport.Dialer {
+	if s.proxyDialer != nil {
+		return s.proxyDialer
+	}
+	return dialerFunc(s.dialContext)
 }
 
 func (s *Speedtest) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -188,24 +322,36 @@ func WithDoer(doer *http.Client) Option {
 // `New(WithDoer(myDoer), WithUserAgent(myUserAgent), WithDoer(myDoer))`
 func WithUserConfig(userConfig *UserConfig) Option {
 	return func(s *Speedtest) {
-		s.NewUserConfig(userConfig)
-		dbg.Printf("Source: %s\n", s.config.Source)
-		dbg.Printf("Proxy: %s\n", s.config.Proxy)
-		dbg.Printf("SavingMode: %v\n", s.config.SavingMode)
-		dbg.Printf("Keyword: %v\n", s.config.Keyword)
-		dbg.Printf("PingType: %v\n", s.config.PingMode)
-		dbg.Printf("OS: %s, ARCH: %s, NumCPU: %d\n", runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+		if err := s.NewUserConfig(userConfig); err != nil {
+			s.logger.Error("invalid user config, the client refuses to dial", "err", err)
+		}
+		s.logger.Debug("user config",
+			"source", s.config.Source,
+			"interface", s.config.Interface,
+			"proxy", s.config.Proxy,
+			"http3", s.config.HTTP3,
+			"saving_mode", s.config.SavingMode,
+			"keyword", s.config.Keyword,
+			"ping_mode", s.config.PingMode,
+			"os", runtime.GOOS,
+			"arch", runtime.GOARCH,
+			"cpus", runtime.NumCPU(),
+		)
 	}
 }
 
 // New creates a new speedtest client.
 func New(opts ...Option) *Speedtest {
 	s := &Speedtest{
-		doer:    http.DefaultClient,
-		Manager: NewDataManager(),
+		doer:         &http.Client{}, // its transport is replaced, never share http.DefaultClient
+		Manager:      NewDataManager(),
+		resolveTimes: &ResolveTimes{},
+		locations:    newLocationTable(),
 	}
+	s.setLogger(discardLogger)
+	s.setClock(wallClock{})
 	// load default config
-	s.NewUserConfig(&UserConfig{UserAgent: DefaultUserAgent})
+	_ = s.NewUserConfig(&UserConfig{UserAgent: DefaultUserAgent})
 
 	for _, opt := range opts {
 		opt(s)
@@ -213,8 +359,36 @@ func New(opts ...Option) *Speedtest {
 	return s
 }
 
+// NewManager returns a manager with the settings of the client manager, to
+// test a server on its own with Server.SetManager.
+func (s *Speedtest) NewManager() Manager {
+	if dm, ok := s.Manager.(*DataManager); ok {
+		return dm.Fork()
+	}
+	dm := NewDataManager()
+	dm.logger = s.logger
+	dm.clock = s.clock
+	return dm
+}
+
+// SetUnit sets the unit of the rates formatted by FormatRate.
+func (s *Speedtest) SetUnit(unit UnitType) {
+	s.unit = unit
+}
+
+// Unit returns the unit of the rates formatted by FormatRate.
+func (s *Speedtest) Unit() UnitType {
+	return s.unit
+}
+
+// FormatRate formats the rate in the unit of the client.
+func (s *Speedtest) FormatRate(r ByteRate) string {
+	return r.Format(s.unit)
+}
+
 func Version() string {
 	return version
 }
 
+// defaultClient serves the deprecated package level functions.
 var defaultClient = New()
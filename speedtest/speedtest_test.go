@@ -1,6 +1,8 @@
 package speedtest
 
 import (
+	"context"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -14,7 +16,7 @@ func BenchmarkLogSpeed(b *testing.B) {
 	}
 	WithUserConfig(config)(s)
 	for i := 0; i < b.N; i++ {
-		dbg.Printf("hello %s\n", "s20080123") // ~1ns/op
+		s.logger.Debug("hello", "server", "s20080123")
 	}
 }
 
@@ -53,7 +55,7 @@ func TestUserAgent(t *testing.T) {
 		s := testServer(DefaultUserAgent)
 		_, err := c.doer.Get(s.URL)
 		if err != nil {
-			t.Errorf(err.Error())
+			t.Error(err.Error())
 		}
 	})
 
@@ -63,7 +65,7 @@ func TestUserAgent(t *testing.T) {
 		c := New(WithUserConfig(&UserConfig{UserAgent: testAgent}))
 		_, err := c.doer.Get(s.URL)
 		if err != nil {
-			t.Errorf(err.Error())
+			t.Error(err.Error())
 		}
 	})
 
@@ -78,7 +80,63 @@ func TestUserAgent(t *testing.T) {
 		}
 		_, err := c.doer.Get(s.URL)
 		if err != nil {
-			t.Errorf(err.Error())
+			t.Error(err.Error())
 		}
 	})
 }
+
+func TestClientIsolation(t *testing.T) {
+	a := New(WithUserConfig(&UserConfig{Debug: true, LocationFlag: "10,20", CityFlag: "a"}))
+	b := New()
+	a.SetUnit(UnitTypeDecimalBytes)
+	b.SetUnit(UnitTypeDefaultMbps)
+
+	rate := ByteRate(125000)
+	if got := a.FormatRate(rate); got != "125.00 KB/s" {
+		t.Errorf("got %s in the unit of a", got)
+	}
+	if got := b.FormatRate(rate); got != "1.00 Mbps" {
+		t.Errorf("got %s in the unit of b", got)
+	}
+	if got := rate.String(); got != rate.Format(UnitTypeDecimalBits) {
+		t.Errorf("the process unit is changed by a client: %s", got)
+	}
+
+	if !a.logger.Enabled(context.Background(), slog.LevelDebug) || b.logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("the debug flag leaks between the clients")
+	}
+	if a.Manager.(*DataManager).logger != a.logger {
+		t.Error("the transfers do not log with the client")
+	}
+
+	if a.config.Location == nil || a.config.Location.Name != "Custom-a" {
+		t.Fatalf("got unexpected location %v", a.config.Location)
+	}
+	if _, err := a.GetLocation("Custom-a"); err != nil {
+		t.Fatal("the location of a is not in its table")
+	}
+	if _, err := b.GetLocation("Custom-a"); err == nil {
+		t.Error("the location of a is visible to b")
+	}
+	if _, err := GetLocation("Custom-a"); err == nil {
+		t.Error("the location of a is added to the process table")
+	}
+	b.NewLocation("mars", 4.5, 137.4)
+	if _, err := b.GetLocation("MARS"); err != nil {
+		t.Error(err)
+	}
+	if _, err := a.GetLocation("mars"); err == nil {
+		t.Error("the location of b is visible to a")
+	}
+	if _, err := a.GetLocation("Tokyo"); err != nil {
+		t.Error("the builtin locations are missing")
+	}
+}
+
+func TestNewLocation(t *testing.T) {
+	defer delete(Locations, "custom-process")
+	NewLocation("Custom-Process", 1, 2)
+	if loc, err := GetLocation("Custom-Process"); err != nil || loc.Lat != 1 {
+		t.Errorf("got %v, %v for the location added to the process table", loc, err)
+	}
+}
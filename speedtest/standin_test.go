@@ -0,0 +1,89 @@
+package speedtest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// speedtestStandIn serves the endpoints of a speedtest server:
+// latency.txt, random{size}x{size}.jpg and upload.php.
+func speedtestStandIn(downloadSize int) http.Handler {
+	payload := []byte(strings.Repeat("speedtest-go", downloadSize/12+1))[:downloadSize]
+	mux := http.NewServeMux()
+	mux.HandleFunc("/speedtest/latency.txt", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "test=test\n")
+	})
+	mux.HandleFunc("/speedtest/upload.php", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		_, _ = fmt.Fprintf(w, "size=%d", n)
+	})
+	mux.HandleFunc("/speedtest/", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/speedtest/random") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write(payload)
+	})
+	return mux
+}
+
+func newSpeedtestStandIn(downloadSize int) *httptest.Server {
+	return httptest.NewServer(speedtestStandIn(downloadSize))
+}
+
+// newPacketLossStandIn listens for the packet loss protocol of a speedtest
+// server on a local tcp and udp port, the PLOSS replies count the packets
+// received so far. It returns the host of the server.
+func newPacketLossStandIn(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		_ = ln.Close()
+		t.Skipf("udp port of the stand-in: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+		_ = pc.Close()
+	})
+	var received atomic.Int64
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, _, err := pc.ReadFrom(buf); err != nil {
+				return
+			}
+			received.Add(1)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					if scanner.Text() == "PLOSS" {
+						n := received.Load()
+						_, _ = fmt.Fprintf(conn, "PLOSS %d 0 %d\n", n, n)
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
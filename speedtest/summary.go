@@ -0,0 +1,178 @@
+package speedtest
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest/transport"
+)
+
+// Summary aggregates a metric over repeated runs.
+type Summary struct {
+	N       int     `json:"n"`
+	Mean    float64 `json:"mean"`
+	Median  float64 `json:"median"`
+	StdDev  float64 `json:"stddev"`            // sample standard deviation
+	CI95    float64 `json:"ci95"`              // half width of the 95% confidence interval of the mean
+	Missing int     `json:"missing,omitempty"` // runs that tested the metric without a value, not in N
+}
+
+// tQuantile95 is the two-sided 95% quantile of the Student t distribution by degrees of freedom.
+var tQuantile95 = [...]float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// Summarize returns the summary of the values, nil if there are none.
+func Summarize(values []float64) *Summary {
+	n := len(values)
+	if n == 0 {
+		return nil
+	}
+	sorted := slices.Sorted(slices.Values(values))
+	s := &Summary{N: n, Median: sorted[n/2]}
+	if n%2 == 0 {
+		s.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	for _, v := range values {
+		s.Mean += v
+	}
+	s.Mean /= float64(n)
+	if n < 2 {
+		return s
+	}
+	var acc float64
+	for _, v := range values {
+		acc += (v - s.Mean) * (v - s.Mean)
+	}
+	s.StdDev = math.Sqrt(acc / float64(n-1))
+	t := 1.960
+	if n-1 <= len(tQuantile95) {
+		t = tQuantile95[n-2]
+	}
+	s.CI95 = t * s.StdDev / math.Sqrt(float64(n))
+	return s
+}
+
+func (s *Summary) String() string {
+	return s.format(func(v float64) string { return fmt.Sprintf("%.2f", v) })
+}
+
+// format formats the summary with the values formatted by f, and tells the
+// runs without a value.
+func (s *Summary) format(f func(v float64) string) string {
+	if s == nil {
+		return "N/A"
+	}
+	missing := ""
+	if s.Missing > 0 {
+		missing = fmt.Sprintf(" (%d of %d runs without a value)", s.Missing, s.N+s.Missing)
+	}
+	if s.N == 0 {
+		return "N/A" + missing
+	}
+	return fmt.Sprintf("mean %s median %s stddev %s ci95 ±%s", f(s.Mean), f(s.Median), f(s.StdDev), f(s.CI95)) + missing
+}
+
+// RunSummary aggregates the results of repeated runs against a server.
+// Latencies are in nanoseconds, rates in bytes per second and the packet
+// loss in percent, a metric is nil if no run tested it. The runs that tested
+// a metric without a value, e.g. a failed transfer, are counted as Missing.
+type RunSummary struct {
+	Runs       int      `json:"runs"`
+	Latency    *Summary `json:"latency,omitempty"`
+	Jitter     *Summary `json:"jitter,omitempty"`
+	Download   *Summary `json:"download,omitempty"`
+	Upload     *Summary `json:"upload,omitempty"`
+	PacketLoss *Summary `json:"packet_loss,omitempty"`
+}
+
+// RecordRun appends the Result of the current fields to Runs, updates the
+// Summary and clears the usage accumulated by the run, call it after each
+// iteration of a repeated test.
+func (s *Server) RecordRun() {
+	s.Runs = append(s.Runs, s.Result())
+	s.Summary = summarizeRuns(s.Runs)
+	s.DataUsage = nil
+}
+
+// ResetRun clears the results of the previous iteration of a repeated test,
+// so that a phase failing in the next one does not record them again and an
+// interrupted iteration does not mark the next one partial. Call it before
+// each iteration.
+func (s *Server) ResetRun() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Latency, s.MaxLatency, s.MinLatency, s.Jitter = 0, 0, 0, 0
+	s.DLSpeed, s.ULSpeed = 0, 0
+	s.DLStats, s.ULStats = TransferStats{}, TransferStats{}
+	s.Bidirectional = nil
+	s.TestDuration, s.Timing = TestDuration{}, TestTiming{}
+	s.TLS = nil
+	s.DataUsage = nil
+	s.PacketLoss = transport.PLoss{}
+	s.Partial = false
+}
+
+func summarizeRuns(runs []Result) *RunSummary {
+	var latency, jitter, download, upload, loss []float64
+	var noLatency, noDownload, noUpload int
+	for _, r := range runs {
+		// a phase was tested if it took time or failed
+		tested := func(d *time.Duration, phase Phase) bool { return d != nil || len(r.Errors[phase]) > 0 }
+		if r.Latency > 0 {
+			latency = append(latency, float64(r.Latency))
+			jitter = append(jitter, float64(r.Jitter))
+		} else if tested(r.TestDuration.Ping, PhasePing) {
+			noLatency++
+		}
+		if r.DLSpeed > 0 {
+			download = append(download, float64(r.DLSpeed))
+		} else if tested(r.TestDuration.Download, PhaseDownload) {
+			noDownload++
+		}
+		if r.ULSpeed > 0 {
+			upload = append(upload, float64(r.ULSpeed))
+		} else if tested(r.TestDuration.Upload, PhaseUpload) {
+			noUpload++
+		}
+		if l := r.PacketLoss.LossPercent(); l >= 0 {
+			loss = append(loss, l)
+		}
+	}
+	return &RunSummary{
+		Runs:       len(runs),
+		Latency:    summarizeMissing(latency, noLatency),
+		Jitter:     summarizeMissing(jitter, noLatency),
+		Download:   summarizeMissing(download, noDownload),
+		Upload:     summarizeMissing(upload, noUpload),
+		PacketLoss: Summarize(loss),
+	}
+}
+
+// summarizeMissing returns the summary of the values and the count of the
+// runs without one, nil if there are neither.
+func summarizeMissing(values []float64, missing int) *Summary {
+	s := Summarize(values)
+	if missing == 0 {
+		return s
+	}
+	if s == nil {
+		s = &Summary{}
+	}
+	s.Missing = missing
+	return s
+}
+
+// LatencyString formats a latency summary as durations.
+func (s *Summary) LatencyString() string {
+	return s.format(func(v float64) string { return time.Duration(v).Round(time.Microsecond).String() })
+}
+
+// RateString formats a rate summary in the unit.
+func (s *Summary) RateString(unit UnitType) string {
+	return s.format(func(v float64) string { return ByteRate(v).Format(unit) })
+}
@@ -0,0 +1,99 @@
+package speedtest
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest/transport"
+)
+
+func TestSummarize(t *testing.T) {
+	if Summarize(nil) != nil {
+		t.Error("expected no summary without values")
+	}
+	s := Summarize([]float64{2, 4, 4, 4, 5, 5, 7, 9})
+	if s.N != 8 || s.Mean != 5 || s.Median != 4.5 {
+		t.Errorf("got unexpected summary %+v", s)
+	}
+	if math.Abs(s.StdDev-2.138) > 0.001 {
+		t.Errorf("got unexpected stddev %v", s.StdDev)
+	}
+	// t(7) = 2.365
+	if math.Abs(s.CI95-2.365*s.StdDev/math.Sqrt(8)) > 1e-9 {
+		t.Errorf("got unexpected ci95 %v", s.CI95)
+	}
+	if one := Summarize([]float64{3}); one.Mean != 3 || one.Median != 3 || one.StdDev != 0 || one.CI95 != 0 {
+		t.Errorf("got unexpected summary of a single value %+v", one)
+	}
+}
+
+func TestRecordRun(t *testing.T) {
+	s := &Server{}
+	for i := 1; i <= 3; i++ {
+		s.Latency = time.Duration(i) * time.Millisecond
+		s.DLSpeed = ByteRate(i * 1000)
+		s.ULSpeed = -1 // N/A
+		s.PacketLoss = transport.PLoss{}
+		s.DataUsage = map[Phase]int64{PhaseDownload: int64(i)}
+		s.RecordRun()
+	}
+	if len(s.Runs) != 3 || s.Runs[0].Latency != time.Millisecond || s.Runs[2].DataUsage[PhaseDownload] != 3 {
+		t.Fatalf("got unexpected runs %+v", s.Runs)
+	}
+	if s.DataUsage != nil {
+		t.Error("the usage is not cleared for the next run")
+	}
+	sum := s.Summary
+	if sum.Runs != 3 || sum.Latency.Mean != float64(2*time.Millisecond) || sum.Download.Median != 2000 {
+		t.Errorf("got unexpected summary %+v", sum)
+	}
+	if sum.Upload != nil || sum.PacketLoss != nil {
+		t.Error("the metrics not measured are summarized")
+	}
+
+	// a run that tested the download without a rate is not hidden
+	d := time.Second
+	s.DLSpeed, s.TestDuration.Download = 0, &d
+	s.RecordRun()
+	if sum = s.Summary; sum.Download.N != 3 || sum.Download.Missing != 1 || sum.Download.Median != 2000 {
+		t.Errorf("got unexpected download summary %+v", sum.Download)
+	}
+	if got := sum.Download.String(); !strings.HasSuffix(got, "(1 of 4 runs without a value)") {
+		t.Errorf("got %q", got)
+	}
+	if got := summarizeRuns(s.Runs[3:]).Download.RateString(UnitTypeDecimalBits); got != "N/A (1 of 1 runs without a value)" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestResetRun(t *testing.T) {
+	ts := newSpeedtestStandIn(1024)
+	server, err := New().CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.PingTest(nil); err != nil {
+		t.Fatal(err)
+	}
+	server.RecordRun()
+
+	// the ping of the next run fails, it must not record the latency of the first
+	ts.Close()
+	server.Partial = true
+	server.ResetRun()
+	if server.Latency != 0 || server.Partial {
+		t.Errorf("got latency %v and partial %v after the reset", server.Latency, server.Partial)
+	}
+	if err = server.PingTest(nil); err == nil {
+		t.Fatal("expected the ping to fail")
+	}
+	server.RecordRun()
+	if server.Runs[0].Latency <= 0 || server.Runs[1].Latency != 0 {
+		t.Errorf("got latencies %v and %v, want the second one not measured", server.Runs[0].Latency, server.Runs[1].Latency)
+	}
+	if server.Summary.Latency.N != 1 {
+		t.Errorf("got %d latencies in the summary, want 1", server.Summary.Latency.N)
+	}
+}
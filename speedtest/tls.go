@@ -0,0 +1,80 @@
+package speedtest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	ErrTLSVersion = errors.New("unsupported tls version")
+	ErrCAFile     = errors.New("no certificate found in the ca file")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses a protocol version such as 1.2 or TLS1.3.
+func parseTLSVersion(version string) (uint16, error) {
+	v := strings.TrimPrefix(strings.ToLower(version), "tls")
+	if tv, ok := tlsVersions[strings.TrimSpace(v)]; ok {
+		return tv, nil
+	}
+	return 0, fmt.Errorf("%w: %s", ErrTLSVersion, version)
+}
+
+// tlsConfig builds the client tls configuration of the user config,
+// nil if nothing has to be changed from the defaults.
+func (uc *UserConfig) tlsConfig() (*tls.Config, error) {
+	if uc.TLSConfig == nil && len(uc.CAFile) == 0 && len(uc.ClientCertFile) == 0 &&
+		len(uc.ClientKeyFile) == 0 && len(uc.TLSMinVersion) == 0 && !uc.InsecureSkipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if uc.TLSConfig != nil {
+		config = uc.TLSConfig.Clone()
+	}
+	if len(uc.CAFile) > 0 {
+		pem, err := os.ReadFile(uc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: %s", ErrCAFile, uc.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if len(uc.ClientCertFile) > 0 || len(uc.ClientKeyFile) > 0 {
+		keyFile := uc.ClientKeyFile
+		if len(keyFile) == 0 {
+			keyFile = uc.ClientCertFile // the key may be bundled with the certificate
+		}
+		cert, err := tls.LoadX509KeyPair(uc.ClientCertFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if len(uc.TLSMinVersion) > 0 {
+		version, err := parseTLSVersion(uc.TLSMinVersion)
+		if err != nil {
+			return nil, err
+		}
+		config.MinVersion = version
+	}
+	if uc.InsecureSkipVerify {
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
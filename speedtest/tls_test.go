@@ -0,0 +1,169 @@
+package speedtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	tls  tls.Certificate
+}
+
+// newTestCert issues a certificate for 127.0.0.1, self-signed if parent is nil.
+func newTestCert(t *testing.T, parent *testCert, serial int64, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "speedtest-go test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, tls: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+// writePEM writes the certificate and, if withKey, its key to a temporary file.
+func (c *testCert) writePEM(t *testing.T, name string, withKey bool) string {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	if withKey {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...)
+	}
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	for input, expected := range map[string]uint16{"1.2": tls.VersionTLS12, "TLS1.3": tls.VersionTLS13, "tls1.0": tls.VersionTLS10} {
+		if v, err := parseTLSVersion(input); err != nil || v != expected {
+			t.Errorf("parseTLSVersion(%q) = %x, %v, expected %x", input, v, err, expected)
+		}
+	}
+	if _, err := parseTLSVersion("1.4"); !errors.Is(err, ErrTLSVersion) {
+		t.Errorf("got unexpected error %v", err)
+	}
+}
+
+func TestUserConfigTLS(t *testing.T) {
+	ca := newTestCert(t, nil, 1, true)
+	serverCert := newTestCert(t, ca, 2, false)
+	clientCert := newTestCert(t, ca, 3, false)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	var verifiedClients atomic.Int64
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			verifiedClients.Add(1)
+		}
+		speedtestStandIn(1024).ServeHTTP(w, r)
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tls},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	c := New(WithDoer(&http.Client{}), WithUserConfig(&UserConfig{
+		CAFile:         ca.writePEM(t, "ca.pem", false),
+		ClientCertFile: clientCert.writePEM(t, "client.pem", true), // the key is bundled
+		TLSMinVersion:  "1.3",
+	}))
+	server, err := c.CustomServer(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.PingTest(nil); err != nil {
+		t.Fatal(err)
+	}
+	if verifiedClients.Load() == 0 {
+		t.Error("the client certificate is not presented")
+	}
+	if server.TLS == nil || server.TLS.Version != "TLS 1.3" || len(server.TLS.CipherSuite) == 0 {
+		t.Errorf("got unexpected tls info %+v", server.TLS)
+	}
+
+	// the private CA is not trusted without the ca file
+	c = New(WithDoer(&http.Client{}), WithUserConfig(&UserConfig{}))
+	if _, err = c.doer.Get(ts.URL + "/speedtest/latency.txt"); err == nil {
+		t.Error("expected an unknown authority error")
+	}
+}
+
+func TestUserConfigInsecureSkipVerify(t *testing.T) {
+	ts := httptest.NewTLSServer(speedtestStandIn(1024))
+	defer ts.Close()
+
+	c := New(WithDoer(&http.Client{}), WithUserConfig(&UserConfig{InsecureSkipVerify: true, TLSMinVersion: "1.2"}))
+	resp, err := c.doer.Get(ts.URL + "/speedtest/latency.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if tlsConfig := c.config.T.TLSClientConfig; tlsConfig == nil || tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("got unexpected tls config %+v", tlsConfig)
+	}
+}
+
+func TestUserConfigInvalidTLS(t *testing.T) {
+	ts := httptest.NewServer(speedtestStandIn(1024))
+	defer ts.Close()
+
+	for name, uc := range map[string]*UserConfig{
+		"ca file":     {CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"min version": {TLSMinVersion: "1.4"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := New(WithDoer(&http.Client{}))
+			if err := c.NewUserConfig(uc); err == nil {
+				t.Fatal("expected error for invalid tls options")
+			}
+			// the requests are refused rather than sent with the default tls options
+			if resp, err := c.doer.Get(ts.URL + "/speedtest/latency.txt"); err == nil {
+				_ = resp.Body.Close()
+				t.Error("the client dialed without the tls options")
+			}
+		})
+	}
+}
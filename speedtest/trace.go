@@ -0,0 +1,180 @@
+package speedtest
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// ConnTiming is the breakdown of the connection phases of a test.
+// Each phase is averaged over the requests that went through it,
+// reused connections skip the DNS, TCP and TLS phases.
+type ConnTiming struct {
+	DNSLookup    time.Duration `json:"dns_lookup"`
+	TCPConnect   time.Duration `json:"tcp_connect"`
+	TLSHandshake time.Duration `json:"tls_handshake"`
+	TTFB         time.Duration `json:"ttfb"` // from the request written to the first response byte
+	Requests     int64         `json:"requests"`
+}
+
+// TestTiming holds the connection timing of each test.
+type TestTiming struct {
+	Ping     *ConnTiming `json:"ping"`
+	Download *ConnTiming `json:"download"`
+	Upload   *ConnTiming `json:"upload"`
+}
+
+type avgDuration struct {
+	sum time.Duration
+	n   int64
+}
+
+func (a *avgDuration) add(d time.Duration) {
+	a.sum += d
+	a.n++
+}
+
+func (a *avgDuration) value() time.Duration {
+	if a.n == 0 {
+		return 0
+	}
+	return a.sum / time.Duration(a.n)
+}
+
+// connTracer collects the timing of every request traced with it.
+type connTracer struct {
+	mu       sync.Mutex
+	dns      avgDuration
+	connect  avgDuration
+	tls      avgDuration
+	ttfb     avgDuration
+	requests int64
+	tlsState *tls.ConnectionState // of the last secured connection
+}
+
+type connTracerKey struct{}
+
+func newConnTracer() *connTracer {
+	return &connTracer{}
+}
+
+// withConnTracer attaches the tracer to the context, the requests made with
+// the returned context are traced by traceContext.
+func withConnTracer(ctx context.Context, ct *connTracer) context.Context {
+	return context.WithValue(ctx, connTracerKey{}, ct)
+}
+
+// traceContext returns a context that traces a single request
+// if a tracer was attached to ctx, otherwise ctx itself.
+func traceContext(ctx context.Context) context.Context {
+	ct, ok := ctx.Value(connTracerKey{}).(*connTracer)
+	if !ok {
+		return ctx
+	}
+	var mu sync.Mutex
+	var dnsStart, connectStart, tlsStart, wroteRequest time.Time
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			ct.observe(&ct.dns, dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			mu.Lock()
+			connectStart = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				ct.observe(&ct.connect, connectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				ct.observe(&ct.tls, tlsStart)
+				ct.observeTLS(state)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			// reused connections skip the handshake
+			if conn, ok := info.Conn.(*tls.Conn); ok {
+				ct.observeTLS(conn.ConnectionState())
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			wroteRequest = time.Now()
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			ct.observe(&ct.ttfb, wroteRequest)
+			ct.mu.Lock()
+			ct.requests++
+			ct.mu.Unlock()
+		},
+	})
+}
+
+func (ct *connTracer) observe(avg *avgDuration, start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	d := time.Since(start)
+	ct.mu.Lock()
+	avg.add(d)
+	ct.mu.Unlock()
+}
+
+func (ct *connTracer) observeTLS(state tls.ConnectionState) {
+	if !state.HandshakeComplete {
+		return
+	}
+	ct.mu.Lock()
+	ct.tlsState = &state
+	ct.mu.Unlock()
+}
+
+// TLS returns the protocol version and cipher suite negotiated with the server,
+// nil if none of the traced requests was secured.
+func (ct *connTracer) TLS() *TLSInfo {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.tlsState == nil {
+		return nil
+	}
+	return &TLSInfo{
+		Version:     tls.VersionName(ct.tlsState.Version),
+		CipherSuite: tls.CipherSuiteName(ct.tlsState.CipherSuite),
+	}
+}
+
+// Timing returns the averaged timing of the traced requests.
+func (ct *connTracer) Timing() *ConnTiming {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return &ConnTiming{
+		DNSLookup:    ct.dns.value(),
+		TCPConnect:   ct.connect.value(),
+		TLSHandshake: ct.tls.value(),
+		TTFB:         ct.ttfb.value(),
+		Requests:     ct.requests,
+	}
+}
@@ -0,0 +1,48 @@
+package speedtest
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestConnTiming(t *testing.T) {
+	ts := httptest.NewTLSServer(speedtestStandIn(64 * 1024))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	// example.com is covered by the certificate of the test server
+	dnsServer := newUDPDNSStandIn(t, net.IPv4(127, 0, 0, 1))
+	c := New(WithDoer(&http.Client{}), WithUserConfig(&UserConfig{DNS: &DNSConfig{Servers: []string{dnsServer}}}))
+	c.config.T.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+	c.SetCaptureTime(time.Second)
+
+	server, err := c.CustomServer("https://example.com:" + u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.PingTest(nil); err != nil {
+		t.Fatal(err)
+	}
+	ping := server.Timing.Ping
+	if ping == nil {
+		t.Fatal("ping timing is not recorded")
+	}
+	if ping.DNSLookup <= 0 || ping.TCPConnect <= 0 || ping.TLSHandshake <= 0 || ping.TTFB <= 0 {
+		t.Errorf("got incomplete ping timing %+v", *ping)
+	}
+	if ping.Requests != 11 {
+		t.Errorf("got unexpected traced requests %d, expected 11", ping.Requests)
+	}
+
+	if err = server.DownloadTest(); err != nil {
+		t.Fatal(err)
+	}
+	download := server.Timing.Download
+	if download == nil || download.Requests == 0 || download.TTFB <= 0 {
+		t.Errorf("got incomplete download timing %+v", download)
+	}
+}
@@ -0,0 +1,362 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrProxyUnsupported = errors.New("proxy does not support this network")
+	ErrProxyRefused     = errors.New("proxy refused the request")
+)
+
+// Dialer dials connections for the transport clients, *net.Dialer satisfies it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+const (
+	socksVersion       = 0x05
+	socksAuthNone      = 0x00
+	socksAuthPassword  = 0x02
+	socksAuthNoAccept  = 0xff
+	socksCmdConnect    = 0x01
+	socksCmdAssociate  = 0x03
+	socksAddrIPv4      = 0x01
+	socksAddrDomain    = 0x03
+	socksAddrIPv6      = 0x04
+	socksReplySucceeds = 0x00
+)
+
+// ProxyDialer tunnels tcp connections through a SOCKS5 (CONNECT) or
+// HTTP (CONNECT) proxy, and udp datagrams through a SOCKS5 proxy (UDP ASSOCIATE).
+type ProxyDialer struct {
+	proxy      *url.URL
+	forward    Dialer
+	forwardUDP Dialer
+}
+
+// NewProxyDialer creates a dialer for the given proxy url, supported schemes are
+// socks, socks5, socks5h, http and https. The forward dialers connect to the proxy
+// and to its udp relay, a default dialer is used if nil.
+func NewProxyDialer(proxy *url.URL, forward, forwardUDP Dialer) (*ProxyDialer, error) {
+	switch proxy.Scheme {
+	case "socks", "socks5", "socks5h", "http", "https":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrProxyUnsupported, proxy.Scheme)
+	}
+	if forward == nil {
+		forward = &net.Dialer{Timeout: 30 * time.Second}
+	}
+	if forwardUDP == nil {
+		forwardUDP = &net.Dialer{Timeout: 30 * time.Second}
+	}
+	return &ProxyDialer{proxy: proxy, forward: forward, forwardUDP: forwardUDP}, nil
+}
+
+func (d *ProxyDialer) isSocks() bool {
+	return d.proxy.Scheme != "http" && d.proxy.Scheme != "https"
+}
+
+// SupportsUDP reports whether udp datagrams can be tunnelled through the proxy.
+func (d *ProxyDialer) SupportsUDP() bool {
+	return d.isSocks()
+}
+
+func (d *ProxyDialer) proxyAddr() string {
+	port := d.proxy.Port()
+	if len(port) == 0 {
+		switch d.proxy.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			port = "1080"
+		}
+	}
+	return net.JoinHostPort(d.proxy.Hostname(), port)
+}
+
+func (d *ProxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		if d.isSocks() {
+			return d.dialSocks(ctx, address)
+		}
+		return d.dialHTTP(ctx, address)
+	case "udp", "udp4", "udp6":
+		if d.isSocks() {
+			return d.associateSocks(ctx, address)
+		}
+	}
+	return nil, fmt.Errorf("%w: %s over %s proxy", ErrProxyUnsupported, network, d.proxy.Scheme)
+}
+
+func (d *ProxyDialer) dialHTTP(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxyAddr())
+	if err != nil {
+		return nil, err
+	}
+	if d.proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrProxyRefused, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn keeps the bytes read ahead while parsing the CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (d *ProxyDialer) dialSocks(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxyAddr())
+	if err != nil {
+		return nil, err
+	}
+	if _, err = d.socksRequest(ctx, conn, socksCmdConnect, address); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *ProxyDialer) associateSocks(ctx context.Context, address string) (net.Conn, error) {
+	header, err := socksAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	ctrl, err := d.forward.DialContext(ctx, "tcp", d.proxyAddr())
+	if err != nil {
+		return nil, err
+	}
+	relay, err := d.socksRequest(ctx, ctrl, socksCmdAssociate, "0.0.0.0:0")
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, err
+	}
+	// an unspecified relay address means the proxy address itself
+	relayHost, relayPort, _ := net.SplitHostPort(relay)
+	if ip := net.ParseIP(relayHost); ip == nil || ip.IsUnspecified() {
+		// the forward dialer may wrap the connection, its address is not always a *net.TCPAddr
+		if relayHost, _, err = net.SplitHostPort(ctrl.RemoteAddr().String()); err != nil {
+			_ = ctrl.Close()
+			return nil, err
+		}
+	}
+	conn, err := d.forwardUDP.DialContext(ctx, "udp", net.JoinHostPort(relayHost, relayPort))
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, err
+	}
+	return &socksUDPConn{Conn: conn, ctrl: ctrl, header: append([]byte{0, 0, 0}, header...)}, nil
+}
+
+// socksRequest performs the SOCKS5 handshake and the given command,
+// returns the address bound by the proxy.
+func (d *ProxyDialer) socksRequest(ctx context.Context, conn net.Conn, cmd byte, address string) (string, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	methods := []byte{socksVersion, 1, socksAuthNone}
+	if d.proxy.User != nil {
+		methods = []byte{socksVersion, 2, socksAuthNone, socksAuthPassword}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return "", err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return "", err
+	}
+	if reply[0] != socksVersion || reply[1] == socksAuthNoAccept {
+		return "", fmt.Errorf("%w: no acceptable authentication method", ErrProxyRefused)
+	}
+	if reply[1] == socksAuthPassword {
+		user := d.proxy.User.Username()
+		password, _ := d.proxy.User.Password()
+		auth := []byte{0x01, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return "", err
+		}
+		if reply[1] != socksReplySucceeds {
+			return "", fmt.Errorf("%w: authentication failed", ErrProxyRefused)
+		}
+	}
+
+	dst, err := socksAddress(address)
+	if err != nil {
+		return "", err
+	}
+	if _, err = conn.Write(append([]byte{socksVersion, cmd, 0}, dst...)); err != nil {
+		return "", err
+	}
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return "", err
+	}
+	if head[1] != socksReplySucceeds {
+		return "", fmt.Errorf("%w: reply code %d", ErrProxyRefused, head[1])
+	}
+	var host string
+	switch head[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if head[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		size := make([]byte, 1)
+		if _, err = io.ReadFull(conn, size); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err = io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("%w: unknown address type %d", ErrProxyRefused, head[3])
+	}
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksAddress encodes the host:port address as ATYP, DST.ADDR and DST.PORT.
+func socksAddress(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %s", host)
+		}
+		b = append([]byte{socksAddrDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socksAddrIPv4}, ip4...)
+	} else {
+		b = append([]byte{socksAddrIPv6}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// socksUDPConn wraps each datagram with the SOCKS5 UDP request header,
+// the association lives as long as the control connection.
+type socksUDPConn struct {
+	net.Conn
+	ctrl   net.Conn
+	header []byte
+}
+
+func (c *socksUDPConn) Write(b []byte) (int, error) {
+	datagram := make([]byte, 0, len(c.header)+len(b))
+	datagram = append(append(datagram, c.header...), b...)
+	if _, err := c.Conn.Write(datagram); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksUDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+262) // maximum header size
+	n, err := c.Conn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	offset := 4
+	if n < offset {
+		return 0, ErrEchoData
+	}
+	switch buf[3] {
+	case socksAddrIPv4:
+		offset += net.IPv4len
+	case socksAddrIPv6:
+		offset += net.IPv6len
+	case socksAddrDomain:
+		offset += 1 + int(buf[4])
+	}
+	offset += 2
+	if n < offset {
+		return 0, ErrEchoData
+	}
+	return copy(b, buf[offset:n]), nil
+}
+
+func (c *socksUDPConn) Close() error {
+	_ = c.ctrl.Close()
+	return c.Conn.Close()
+}
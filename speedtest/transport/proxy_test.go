@@ -0,0 +1,259 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, network string) net.Listener {
+	ln, err := net.Listen(network, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	return ln
+}
+
+func serve(ln net.Listener, handle func(conn net.Conn)) {
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+}
+
+func newTCPEcho(t *testing.T) string {
+	ln := listen(t, "tcp")
+	serve(ln, func(conn net.Conn) { _, _ = io.Copy(conn, conn) })
+	return ln.Addr().String()
+}
+
+func newUDPEcho(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// readSocksAddress reads ATYP, DST.ADDR and DST.PORT.
+func readSocksAddress(r io.Reader) string {
+	atyp := make([]byte, 1)
+	_, _ = io.ReadFull(r, atyp)
+	var host string
+	switch atyp[0] {
+	case socksAddrIPv4:
+		ip := make(net.IP, net.IPv4len)
+		_, _ = io.ReadFull(r, ip)
+		host = ip.String()
+	case socksAddrDomain:
+		size := make([]byte, 1)
+		_, _ = io.ReadFull(r, size)
+		domain := make([]byte, size[0])
+		_, _ = io.ReadFull(r, domain)
+		host = string(domain)
+	}
+	port := make([]byte, 2)
+	_, _ = io.ReadFull(r, port)
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+}
+
+// newSocks5Proxy serves CONNECT and UDP ASSOCIATE without authentication.
+func newSocks5Proxy(t *testing.T) string {
+	ln := listen(t, "tcp")
+	serve(ln, func(conn net.Conn) {
+		head := make([]byte, 2)
+		_, _ = io.ReadFull(conn, head)
+		_, _ = io.ReadFull(conn, make([]byte, head[1]))
+		_, _ = conn.Write([]byte{socksVersion, socksAuthNone})
+		req := make([]byte, 3)
+		_, _ = io.ReadFull(conn, req)
+		dst := readSocksAddress(conn)
+		switch req[1] {
+		case socksCmdConnect:
+			upstream, err := net.Dial("tcp", dst)
+			if err != nil {
+				_, _ = conn.Write([]byte{socksVersion, 0x05, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer upstream.Close()
+			_, _ = conn.Write([]byte{socksVersion, socksReplySucceeds, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+			go func() { _, _ = io.Copy(upstream, conn) }()
+			_, _ = io.Copy(conn, upstream)
+		case socksCmdAssociate:
+			relay, _ := net.ListenPacket("udp", "127.0.0.1:0")
+			defer relay.Close()
+			port := relay.LocalAddr().(*net.UDPAddr).Port
+			reply := []byte{socksVersion, socksReplySucceeds, 0, socksAddrIPv4, 0, 0, 0, 0}
+			_, _ = conn.Write(binary.BigEndian.AppendUint16(reply, uint16(port)))
+			go func() {
+				var client net.Addr
+				buf := make([]byte, 1500)
+				for {
+					n, addr, err := relay.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					if client == nil || addr.String() == client.String() {
+						client = addr
+						reader := bytes.NewReader(buf[3:n])
+						target, _ := net.ResolveUDPAddr("udp", readSocksAddress(reader))
+						payload, _ := io.ReadAll(reader)
+						_, _ = relay.WriteTo(payload, target)
+						continue
+					}
+					header, _ := socksAddress(addr.String())
+					_, _ = relay.WriteTo(append(append([]byte{0, 0, 0}, header...), buf[:n]...), client)
+				}
+			}()
+			_, _ = io.Copy(io.Discard, conn) // association ends with the control connection
+		}
+	})
+	return ln.Addr().String()
+}
+
+func newHTTPConnectProxy(t *testing.T) string {
+	ln := listen(t, "tcp")
+	serve(ln, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		upstream, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer upstream.Close()
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() { _, _ = io.Copy(upstream, conn) }()
+		_, _ = io.Copy(conn, upstream)
+	})
+	return ln.Addr().String()
+}
+
+func echo(t *testing.T, conn net.Conn, message string) {
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != message {
+		t.Errorf("got unexpected echo %q, expected %q", buf, message)
+	}
+}
+
+func TestProxyDialer(t *testing.T) {
+	tcpEcho := newTCPEcho(t)
+	udpEcho := newUDPEcho(t)
+	testData := []struct {
+		proxy string
+		udp   bool
+	}{
+		{"socks5://" + newSocks5Proxy(t), true},
+		{"http://" + newHTTPConnectProxy(t), false},
+	}
+	for _, td := range testData {
+		proxyURL, _ := url.Parse(td.proxy)
+		dialer, err := NewProxyDialer(proxyURL, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(proxyURL.Scheme+"/tcp", func(t *testing.T) {
+			conn, err := dialer.DialContext(context.Background(), "tcp", tcpEcho)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			echo(t, conn, "PING 1234567890123\n")
+		})
+		t.Run(proxyURL.Scheme+"/udp", func(t *testing.T) {
+			if dialer.SupportsUDP() != td.udp {
+				t.Fatalf("got unexpected udp support %v", dialer.SupportsUDP())
+			}
+			conn, err := dialer.DialContext(context.Background(), "udp", udpEcho)
+			if !td.udp {
+				if err == nil {
+					t.Fatal("expected error for udp over http proxy")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			echo(t, conn, "LOSS 1 0 uuid")
+		})
+	}
+}
+
+// wrappedConn hides the *net.TCPAddr of the connection, like a shaping or counting wrapper may.
+type wrappedConn struct {
+	net.Conn
+}
+
+type wrappedAddr string
+
+func (a wrappedAddr) Network() string { return "tcp" }
+func (a wrappedAddr) String() string  { return string(a) }
+
+func (c wrappedConn) RemoteAddr() net.Addr {
+	return wrappedAddr(c.Conn.RemoteAddr().String())
+}
+
+type wrappingDialer struct {
+	net.Dialer
+}
+
+func (d *wrappingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return wrappedConn{conn}, nil
+}
+
+func TestProxyDialerWrappedForward(t *testing.T) {
+	proxyURL, _ := url.Parse("socks5://" + newSocks5Proxy(t))
+	dialer, err := NewProxyDialer(proxyURL, &wrappingDialer{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the relay address is unspecified, so the proxy is reached at the address of the wrapped connection
+	conn, err := dialer.DialContext(context.Background(), "udp", newUDPEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "LOSS 1 0 uuid")
+}
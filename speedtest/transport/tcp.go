@@ -38,12 +38,12 @@ type Client struct {
 	host    string
 	version string
 
-	dialer *net.Dialer
+	dialer Dialer
 
 	reader *bufio.Reader
 }
 
-func NewClient(dialer *net.Dialer) (*Client, error) {
+func NewClient(dialer Dialer) (*Client, error) {
 	uuid, err := generateUUID()
 	if err != nil {
 		return nil, err
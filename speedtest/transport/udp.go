@@ -23,10 +23,10 @@ type PacketLossSender struct {
 	conn          net.Conn // UDP Conn
 	raw           []byte
 	host          string
-	dialer        *net.Dialer
+	dialer        Dialer
 }
 
-func NewPacketLossSender(uuid string, dialer *net.Dialer) (*PacketLossSender, error) {
+func NewPacketLossSender(uuid string, dialer Dialer) (*PacketLossSender, error) {
 	rd := mrand.New(mrand.NewSource(time.Now().UnixNano()))
 	nounce := rd.Int63n(10000000000)
 	p := &PacketLossSender{
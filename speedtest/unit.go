@@ -1,7 +1,11 @@
 package speedtest
 
 import (
+	"errors"
+	"fmt"
 	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 type UnitType int
@@ -41,26 +45,69 @@ const (
 	GiB = 1024 * MiB
 )
 
+var ErrByteSize = errors.New("invalid byte size")
+
+var byteSizeUnits = map[string]float64{
+	"":    B,
+	"B":   B,
+	"K":   KB,
+	"KB":  KB,
+	"M":   MB,
+	"MB":  MB,
+	"G":   GB,
+	"GB":  GB,
+	"KIB": KiB,
+	"MIB": MiB,
+	"GIB": GiB,
+}
+
+// ParseByteSize parses a data volume such as 500MB, 1.5GB or 256MiB.
+// A number without unit is in bytes.
+func ParseByteSize(size string) (int64, error) {
+	s := strings.TrimSpace(size)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(s)
+	}
+	value, err := strconv.ParseFloat(s[:i], 64)
+	unit, ok := byteSizeUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if err != nil || !ok || value < 0 {
+		return 0, fmt.Errorf("%w: %q", ErrByteSize, size)
+	}
+	return int64(value * unit), nil
+}
+
 type ByteRate float64
 
-var globalByteRateUnit UnitType
+// globalByteRateUnit is the unit of ByteRate.String, see SetUnit.
+var globalByteRateUnit atomic.Int64
 
 func (r ByteRate) String() string {
+	return r.Format(UnitType(globalByteRateUnit.Load()))
+}
+
+// Format formats the rate in the unit.
+func (r ByteRate) Format(unit UnitType) string {
 	if r == 0 {
 		return "0.00 Mbps"
 	}
 	if r == -1 {
 		return "N/A"
 	}
-	if globalByteRateUnit != UnitTypeDefaultMbps {
-		return r.Byte(globalByteRateUnit)
+	if unit != UnitTypeDefaultMbps {
+		return r.Byte(unit)
 	}
 	return strconv.FormatFloat(float64(r/125000.0), 'f', 2, 64) + " Mbps"
 }
 
 // SetUnit Set global output units
+//
+// Deprecated: the unit is shared by the whole process, use Speedtest.SetUnit
+// and Speedtest.FormatRate instead. SetUnit only changes ByteRate.String.
 func SetUnit(unit UnitType) {
-	globalByteRateUnit = unit
+	globalByteRateUnit.Store(int64(unit))
 }
 
 func (r ByteRate) Mbps() float64 {
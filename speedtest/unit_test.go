@@ -58,3 +58,16 @@ func TestFmt(t *testing.T) {
 		}
 	}
 }
+
+func TestParseByteSize(t *testing.T) {
+	for input, expected := range map[string]int64{"1GB": 1000000000, "500 MB": 500000000, "1.5k": 1500, "256MiB": 256 * MiB, "42": 42} {
+		if size, err := ParseByteSize(input); err != nil || size != expected {
+			t.Errorf("ParseByteSize(%q) = %d, %v, expected %d", input, size, err, expected)
+		}
+	}
+	for _, input := range []string{"", "GB", "1TB", "-1MB"} {
+		if _, err := ParseByteSize(input); err == nil {
+			t.Errorf("ParseByteSize(%q) expected an error", input)
+		}
+	}
+}
@@ -10,6 +10,8 @@ import (
 
 const speedTestConfigUrl = "https://www.speedtest.net/speedtest-config.php"
 
+var ErrUserNotFound = errors.New("failed to fetch user information")
+
 // User represents information determined about the caller by speedtest.net
 type User struct {
 	IP  string `xml:"ip,attr"`
@@ -29,13 +31,17 @@ func (s *Speedtest) FetchUserInfo() (*User, error) {
 }
 
 // FetchUserInfo returns information about caller determined by speedtest.net
+//
+// Deprecated: the default client is shared by the whole process, use the
+// method of a client created with New instead.
 func FetchUserInfo() (*User, error) {
 	return defaultClient.FetchUserInfo()
 }
 
 // FetchUserInfoContext returns information about caller determined by speedtest.net, observing the given context.
-func (s *Speedtest) FetchUserInfoContext(ctx context.Context) (*User, error) {
-	dbg.Printf("Retrieving user info: %s\n", speedTestConfigUrl)
+func (s *Speedtest) FetchUserInfoContext(ctx context.Context) (_ *User, err error) {
+	defer func() { err = wrapError(PhaseDiscovery, "", err) }()
+	s.logger.Debug("retrieving user info", "url", speedTestConfigUrl)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, speedTestConfigUrl, nil)
 	if err != nil {
 		return nil, err
@@ -57,7 +63,7 @@ func (s *Speedtest) FetchUserInfoContext(ctx context.Context) (*User, error) {
 	}
 
 	if len(users.Users) == 0 {
-		return nil, errors.New("failed to fetch user information")
+		return nil, ErrUserNotFound
 	}
 
 	s.User = &users.Users[0]
@@ -65,6 +71,9 @@ func (s *Speedtest) FetchUserInfoContext(ctx context.Context) (*User, error) {
 }
 
 // FetchUserInfoContext returns information about caller determined by speedtest.net, observing the given context.
+//
+// Deprecated: the default client is shared by the whole process, use the
+// method of a client created with New instead.
 func FetchUserInfoContext(ctx context.Context) (*User, error) {
 	return defaultClient.FetchUserInfoContext(ctx)
 }
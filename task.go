@@ -1,16 +1,33 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/chelnak/ysmrr"
+	"github.com/showwin/speedtest-go/speedtest"
 	"os"
 	"strings"
 )
 
+// exit codes of the command
+const (
+	exitOK          = iota
+	exitFailure     // invalid flags and unexpected errors
+	exitDiscovery   // the user information or the servers cannot be fetched
+	exitNoServer    // none of the servers is reachable
+	exitTestFailure // a test of a server failed
+	exitThreshold   // a server is beyond --min-download, --min-upload or --max-latency
+
+	exitInterrupted = 130 // by ctrl-c or SIGTERM, as a shell reports it
+)
+
 type TaskManager struct {
 	sm         ysmrr.SpinnerManager
 	isOut      bool
 	noProgress bool
+	jsonOutput bool // the fatal errors are printed as json objects
 }
 
 type Task struct {
@@ -21,7 +38,7 @@ type Task struct {
 
 func InitTaskManager(jsonOutput, unixOutput bool) *TaskManager {
 	isOut := !jsonOutput || unixOutput
-	tm := &TaskManager{sm: ysmrr.NewSpinnerManager(), isOut: isOut, noProgress: unixOutput}
+	tm := &TaskManager{sm: ysmrr.NewSpinnerManager(), isOut: isOut, noProgress: unixOutput, jsonOutput: jsonOutput}
 	if isOut && !unixOutput {
 		tm.sm.Start()
 	}
@@ -132,13 +149,50 @@ func (t *Task) Printf(format string, a ...interface{}) {
 
 func (t *Task) CheckError(err error) {
 	if err != nil {
+		code := exitCode(err)
 		if t.spinner != nil {
 			t.Printf("Fatal: %s, err: %v", strings.ToLower(t.title), err)
 			t.spinner.Error()
 			t.manager.Stop()
+		} else if t.manager.jsonOutput {
+			fmt.Println(jsonError(err, code))
 		} else {
-			fmt.Printf("Fatal: %s, err: %v", strings.ToLower(t.title), err)
+			fmt.Printf("Fatal: %s, err: %v\n", strings.ToLower(t.title), err)
 		}
-		os.Exit(0)
+		os.Exit(code)
+	}
+}
+
+// exitCode classifies the error of a task.
+func exitCode(err error) int {
+	if errors.Is(err, context.Canceled) {
+		return exitInterrupted
 	}
+	if errors.Is(err, speedtest.ErrServerNotFound) || errors.Is(err, speedtest.ErrNoAvailableServers) {
+		return exitNoServer
+	}
+	var e *speedtest.Error
+	if !errors.As(err, &e) {
+		return exitFailure
+	}
+	if e.Phase == speedtest.PhaseDiscovery {
+		return exitDiscovery
+	}
+	return exitTestFailure
+}
+
+// jsonError encodes the error as {"error": {...}, "exit_code": code}.
+func jsonError(err error, code int) string {
+	var body any = struct {
+		Message string `json:"message"`
+	}{err.Error()}
+	var e *speedtest.Error
+	if errors.As(err, &e) {
+		body = e
+	}
+	b, _ := json.Marshal(struct {
+		Error    any `json:"error"`
+		ExitCode int `json:"exit_code"`
+	}{body, code})
+	return string(b)
 }